@@ -2,7 +2,10 @@ package auth
 
 import (
 	"testing"
+	"time"
 
+	ex "github.com/eensymachines-in/errx"
+	"github.com/go-redis/redis/v7"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -70,3 +73,74 @@ func TestToken(t *testing.T) {
 // 	assert.Nil(t, cac.LoginUser("kneeru@gmail.com", 2, anotherResult), "Unexpected error when logging in from another node")
 // 	assert.Nil(t, cac.LogoutUser(result), "Unexpected error in logging user out")
 // }
+
+// testCache : connects to the cache as in docker-compose, tests that need the cache are skipped when it isnt up
+func testCache(t *testing.T) *TokenCache {
+	cac := &TokenCache{Client: redis.NewClient(&redis.Options{
+		Addr:     "localhost:6379",
+		Password: "", // no password set
+		DB:       0,  // use default DB
+	})}
+	if err := cac.Ping(); err != nil {
+		cac.Close()
+		t.Skipf("Cache isnt up, skipping: %s", err)
+	}
+	return cac
+}
+
+func TestCacheScopes(t *testing.T) {
+	cac := testCache(t)
+	defer cac.Close()
+	result := &TokenPair{}
+	assert.Nil(t, cac.LoginUser("kneeru@gmail.com", 2, result, LoginScopes("devices:lock", "devices:read")), "Unexpected error logging in")
+	assert.True(t, result.Auth.HasAllScopes("devices:lock", "devices:read"), "Unexpected scopes on the auth token")
+	assert.True(t, result.Refr.HasAllScopes("devices:lock", "devices:read"), "Unexpected scopes on the refr token")
+
+	refreshed := &TokenPair{}
+	assert.NotNil(t, cac.RefreshUser(result.Refr, refreshed, "users:delete"), "Was expecting error when refreshing with scope never granted")
+	assert.Nil(t, cac.RefreshUser(result.Refr, refreshed, "devices:read"), "Unexpected error refreshing down-scoped")
+	assert.Equal(t, []string{"devices:read"}, refreshed.Auth.Scopes, "Unexpected scopes on down-scoped auth token")
+	assert.Equal(t, []string{"devices:lock", "devices:read"}, refreshed.Refr.Scopes, "Refr token should keep the scopes of the login")
+	cac.LogoutToken(refreshed.Auth)
+	cac.LogoutToken(refreshed.Refr)
+}
+
+func TestAtomicLogin(t *testing.T) {
+	down := &TokenCache{Client: redis.NewClient(&redis.Options{Addr: "localhost:1"})}
+	defer down.Close()
+	result := &TokenPair{}
+	err := down.LoginUser("kneeru@gmail.com", 2, result)
+	_, ok := err.(*ex.ErrCacheQuery)
+	assert.True(t, ok, "Unexpected error %v when cache is down", err)
+	assert.Nil(t, result.Auth, "Was not expecting tokens when login failed")
+
+	cac := testCache(t)
+	defer cac.Close()
+	keyA, keyB := tokKey("kneeru@gmail.com", "atomic-login-a"), tokKey("kneeru@gmail.com", "atomic-login-b")
+	cac.Client.Set(keyB, "taken", time.Minute)
+	_, err = cac.setAll("kneeru@gmail.com", &loginConf{session: "atomic-login", fresh: true}, nil, SessionLimit{}, []cacheEntry{
+		{key: keyA, val: "a", ttl: time.Minute},
+		{key: keyB, val: "b", ttl: time.Minute},
+	}, "TestAtomicLogin")
+	assert.NotNil(t, err, "Was expecting error when one of the keys is taken")
+	n, _ := cac.Client.Exists(keyA).Result()
+	assert.Equal(t, int64(0), n, "None of the keys should be set when one is taken")
+	val, _ := cac.Client.Get(keyB).Result()
+	assert.Equal(t, "taken", val, "Key taken should not be overwritten")
+	cac.Client.Del(keyB)
+	// session that is not new has to be alive, else it would be brought back without its cap
+	_, err = cac.setAll("kneeru@gmail.com", &loginConf{session: "atomic-login-gone"}, nil, SessionLimit{}, []cacheEntry{
+		{key: keyA, val: "a", ttl: time.Minute},
+	}, "TestAtomicLogin")
+	assert.NotNil(t, err, "Was expecting error when the session is gone")
+	n, _ = cac.Client.Exists(keyA, sessKey("kneeru@gmail.com", "atomic-login-gone")).Result()
+	assert.Equal(t, int64(0), n, "Nothing should be set when the session is gone")
+
+	assert.Nil(t, cac.LoginUser("kneeru@gmail.com", 2, result), "Unexpected error logging in")
+	ttl, _ := cac.Client.PTTL(tokKey(result.Auth.User, result.Auth.UUID)).Result()
+	assert.True(t, ttl > 0 && ttl <= AuthExp, "Unexpected ttl %s on auth token", ttl)
+	ttl, _ = cac.Client.PTTL(tokKey(result.Refr.User, result.Refr.UUID)).Result()
+	assert.True(t, ttl > AuthExp && ttl <= RefrExp, "Unexpected ttl %s on refr token", ttl)
+	cac.LogoutToken(result.Auth)
+	cac.LogoutToken(result.Refr)
+}
@@ -0,0 +1,360 @@
+package auth
+
+/*
+Registered claims (RFC 7519) on the tokens, and their validation when the tokens are parsed
+iss, aud : which AuthAPI issued the token and the services that the token is meant for
+sub, jti : same as the user and the uuid on the token
+sid : login session the token belongs to, all the tokens rotated from one login have the same
+iat, nbf, exp : times at which the token was issued, starts and stops being valid
+Tokens minted for one product are rejected by the other when the services expect their own issuer/audience
+Services can carry their own custom claims on the token - tenant, device serial, display name ..
+custom claims cannot override the ones above
+*/
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	ex "github.com/eensymachines-in/errx"
+)
+
+const (
+	// defaultLeeway : clock skew between the service that issues and the one that verifies
+	defaultLeeway = 10 * time.Second
+)
+
+const (
+	// UseAuth : token_use of the auth token of a pair
+	UseAuth = "auth"
+	// UseRefr : token_use of the refr token of a pair, never good to authenticate a request
+	UseRefr = "refr"
+)
+
+// reservedClaims : claims the package uses, custom claims by the same name are ignored
+var reservedClaims = map[string]bool{
+	"user": true, "role": true, "uuid": true, "scope": true, "sid": true, "client_type": true, "token_use": true,
+	"iss": true, "aud": true, "sub": true, "jti": true, "iat": true, "nbf": true, "exp": true,
+}
+
+// TokOption : optional claims on the new token
+type TokOption func(jt *JWTok)
+
+// WithIssuer : stamps the iss claim, typically the url of the AuthAPI
+func WithIssuer(iss string) TokOption {
+	return func(jt *JWTok) {
+		jt.Issuer = iss
+	}
+}
+
+// WithAudience : stamps the aud claim, services the token is meant for
+func WithAudience(aud ...string) TokOption {
+	return func(jt *JWTok) {
+		jt.Audience = aud
+	}
+}
+
+// WithSession : stamps the sid claim, login session the token belongs to
+func WithSession(sid string) TokOption {
+	return func(jt *JWTok) {
+		jt.Session = sid
+	}
+}
+
+// WithClient : stamps the client_type claim, type of client the login is from - web, mobile, device
+func WithClient(client string) TokOption {
+	return func(jt *JWTok) {
+		jt.Client = client
+	}
+}
+
+// WithUse : stamps the token_use claim, what the token of a pair is for - UseAuth or UseRefr
+func WithUse(use string) TokOption {
+	return func(jt *JWTok) {
+		jt.Use = use
+	}
+}
+
+// WithClaims : custom claims on the token, can be called more than once
+// values have to be json marshalable, reserved claims are ignored
+func WithClaims(custom map[string]interface{}) TokOption {
+	return func(jt *JWTok) {
+		if jt.Custom == nil {
+			jt.Custom = map[string]interface{}{}
+		}
+		for k, v := range custom {
+			if !reservedClaims[k] {
+				jt.Custom[k] = v
+			}
+		}
+	}
+}
+
+// ClaimsInto : decodes the custom claims on the token into the struct, json tags are the claim names
+// after parsing, custom claims are as read from json - numbers are float64, arrays are []interface{}, hence this
+// ErrInvalid : custom claims do not fit the struct
+func (jt *JWTok) ClaimsInto(v interface{}) error {
+	byt, err := json.Marshal(jt.Custom)
+	if err != nil {
+		return ex.NewErr(&ex.ErrInvalid{}, err, "Failed to read custom claims on the token", "JWTok.ClaimsInto/json.Marshal")
+	}
+	if err := json.Unmarshal(byt, v); err != nil {
+		return ex.NewErr(&ex.ErrInvalid{}, err, "Failed to read custom claims on the token", "JWTok.ClaimsInto/json.Unmarshal")
+	}
+	return nil
+}
+
+// mapClaims : claims as they go on the jwt
+func (jt *JWTok) mapClaims() jwt.MapClaims {
+	claims := jwt.MapClaims{}
+	for k, v := range jt.Custom {
+		if !reservedClaims[k] {
+			claims[k] = v
+		}
+	}
+	claims["user"] = jt.User
+	claims["role"] = jt.Role
+	claims["uuid"] = jt.UUID
+	claims["sub"] = jt.User
+	claims["jti"] = jt.UUID
+	claims["iat"] = jt.IssuedAt.Unix()
+	claims["nbf"] = jt.NotBefore.Unix()
+	claims["exp"] = jt.IssuedAt.Add(jt.Exp).Unix() //note this is the time AT which the token expires as unix seconds
+	if jt.Issuer != "" {
+		claims["iss"] = jt.Issuer
+	}
+	if len(jt.Scopes) > 0 {
+		claims["scope"] = joinScopes(jt.Scopes)
+	}
+	if jt.Session != "" {
+		claims["sid"] = jt.Session
+	}
+	if jt.Client != "" {
+		claims["client_type"] = jt.Client
+	}
+	if jt.Use != "" {
+		claims["token_use"] = jt.Use
+	}
+	if len(jt.Audience) == 1 {
+		claims["aud"] = jt.Audience[0]
+	} else if len(jt.Audience) > 1 {
+		claims["aud"] = jt.Audience
+	}
+	return claims
+}
+
+// ParseOption : expectations on the registered claims when parsing the token
+type ParseOption func(pc *parseConf)
+
+// parseConf : what the claims are validated against
+type parseConf struct {
+	issuer   string
+	audience string
+	leeway   time.Duration
+	expired  bool // expired tokens are let through, the cache has the last word on them
+}
+
+// ExpectIssuer : token is rejected unless the iss claim is the same
+func ExpectIssuer(iss string) ParseOption {
+	return func(pc *parseConf) {
+		pc.issuer = iss
+	}
+}
+
+// ExpectAudience : token is rejected unless the aud claim has the audience
+func ExpectAudience(aud string) ParseOption {
+	return func(pc *parseConf) {
+		pc.audience = aud
+	}
+}
+
+// WithLeeway : allowance for the clock skew when validating exp, nbf and iat
+func WithLeeway(d time.Duration) ParseOption {
+	return func(pc *parseConf) {
+		pc.leeway = d
+	}
+}
+
+// allowExpired : exp is not validated, for when the cache is checked after
+func allowExpired() ParseOption {
+	return func(pc *parseConf) {
+		pc.expired = true
+	}
+}
+
+func newParseConf(opts []ParseOption) *parseConf {
+	result := &parseConf{leeway: defaultLeeway}
+	for _, opt := range opts {
+		opt(result)
+	}
+	return result
+}
+
+// tokClaims : claims on the token decoded into their types
+type tokClaims struct {
+	User      string
+	Role      int
+	UUID      string
+	Issuer    string
+	Audience  []string
+	IssuedAt  time.Time
+	NotBefore time.Time
+	ExpiresAt time.Time
+	Scopes    []string
+	Session   string
+	Client    string
+	Use       string
+	Custom    map[string]interface{}
+}
+
+// claimErr : token is signed alright but the claim is missing or isnt of the type expected
+// could be a token from another issuer sharing the key
+func claimErr(claim, ctx string) *TokErr {
+	return &TokErr{Errx: ex.NewErr(&ex.ErrInvalid{}, nil, fmt.Sprintf("Authentication has missing/invalid claim '%s', please sign again", claim), ctx), kind: ErrTokClaims}
+}
+
+// claimTime : reads the numeric date claim, false if the claim is missing
+// TokErr : claim is there but isnt a number
+func claimTime(claims jwt.MapClaims, key string) (time.Time, bool, error) {
+	val, ok := claims[key]
+	if !ok {
+		return time.Time{}, false, nil
+	}
+	f, ok := val.(float64)
+	if !ok {
+		return time.Time{}, false, claimErr(key, "claimTime")
+	}
+	return time.Unix(int64(f), 0), true, nil
+}
+
+// claimString : reads the string claim, false if the claim is missing
+// TokErr : claim is there but isnt a string
+func claimString(claims jwt.MapClaims, key string) (string, bool, error) {
+	val, ok := claims[key]
+	if !ok {
+		return "", false, nil
+	}
+	str, ok := val.(string)
+	if !ok {
+		return "", false, claimErr(key, "claimString")
+	}
+	return str, true, nil
+}
+
+// claimAudience : aud claim can either be a string or an array of strings
+// TokErr : claim is there but is neither
+func claimAudience(claims jwt.MapClaims) ([]string, error) {
+	switch aud := claims["aud"].(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return []string{aud}, nil
+	case []interface{}:
+		result := []string{}
+		for _, a := range aud {
+			s, ok := a.(string)
+			if !ok {
+				return nil, claimErr("aud", "claimAudience")
+			}
+			result = append(result, s)
+		}
+		return result, nil
+	}
+	return nil, claimErr("aud", "claimAudience")
+}
+
+// decodeClaims : reads the claims on the token into their types
+// user, role, uuid and exp are mandatory, rest of them are validated only if present
+// TokErr : ErrTokClaims when the claim is missing or isnt of the type expected
+func decodeClaims(claims jwt.MapClaims) (*tokClaims, error) {
+	result := &tokClaims{}
+	var ok bool
+	var err error
+	if result.User, ok, err = claimString(claims, "user"); err != nil || !ok || result.User == "" {
+		return nil, claimErr("user", "decodeClaims")
+	}
+	if result.UUID, ok, err = claimString(claims, "uuid"); err != nil || !ok || result.UUID == "" {
+		return nil, claimErr("uuid", "decodeClaims")
+	}
+	role, ok := claims["role"].(float64) // here when inside the claims its always stored as float64
+	if !ok || role != float64(int(role)) {
+		return nil, claimErr("role", "decodeClaims")
+	}
+	result.Role = int(role)
+	if result.ExpiresAt, ok, err = claimTime(claims, "exp"); err != nil || !ok {
+		return nil, claimErr("exp", "decodeClaims")
+	}
+	if result.IssuedAt, _, err = claimTime(claims, "iat"); err != nil {
+		return nil, err
+	}
+	if result.NotBefore, _, err = claimTime(claims, "nbf"); err != nil {
+		return nil, err
+	}
+	if result.Issuer, _, err = claimString(claims, "iss"); err != nil {
+		return nil, err
+	}
+	if result.Audience, err = claimAudience(claims); err != nil {
+		return nil, err
+	}
+	scope, _, err := claimString(claims, "scope")
+	if err != nil {
+		return nil, err
+	}
+	result.Scopes = splitScopes(scope)
+	if result.Session, _, err = claimString(claims, "sid"); err != nil {
+		return nil, err
+	}
+	if result.Client, _, err = claimString(claims, "client_type"); err != nil {
+		return nil, err
+	}
+	if result.Use, _, err = claimString(claims, "token_use"); err != nil {
+		return nil, err
+	}
+	for _, key := range []string{"sub", "jti"} {
+		if _, _, err = claimString(claims, key); err != nil {
+			return nil, err
+		}
+	}
+	for k, v := range claims {
+		if reservedClaims[k] {
+			continue
+		}
+		if result.Custom == nil {
+			result.Custom = map[string]interface{}{}
+		}
+		result.Custom[k] = v
+	}
+	return result, nil
+}
+
+// validate : validates the registered claims on the token
+// TokErr : ErrTokExpired, ErrTokNotYetValid, or ErrTokClaims when it was not issued by / for the expected
+func (pc *parseConf) validate(tc *tokClaims) error {
+	now := time.Now()
+	if !pc.expired && now.After(tc.ExpiresAt.Add(pc.leeway)) {
+		return newTokErr(ErrTokExpired, nil, "parseConf.validate/exp")
+	}
+	if !tc.NotBefore.IsZero() && now.Add(pc.leeway).Before(tc.NotBefore) {
+		return newTokErr(ErrTokNotYetValid, nil, "parseConf.validate/nbf")
+	}
+	if !tc.IssuedAt.IsZero() && now.Add(pc.leeway).Before(tc.IssuedAt) {
+		return newTokErr(ErrTokNotYetValid, nil, "parseConf.validate/iat")
+	}
+	if pc.issuer != "" && tc.Issuer != pc.issuer {
+		return newTokErr(ErrTokClaims, nil, "parseConf.validate/iss")
+	}
+	if pc.audience != "" {
+		found := false
+		for _, aud := range tc.Audience {
+			if aud == pc.audience {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return newTokErr(ErrTokClaims, nil, "parseConf.validate/aud")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package auth
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegisteredClaims(t *testing.T) {
+	authTok := NewToken("kneeru@gmail.com", 2, AuthExp, WithIssuer("https://auth.eensymachines.in"), WithAudience("autolumin", "aquaminder"))
+	tokStr, _ := authTok.ToString("secretstring")
+	tok, err := tokStr.Parse("secretstring", ExpectIssuer("https://auth.eensymachines.in"), ExpectAudience("aquaminder"))
+	assert.Nil(t, err, "Unexpected error when parsing token with expected issuer and audience")
+	assert.Equal(t, "https://auth.eensymachines.in", tok.Issuer, "Unexpected issuer on the token")
+	assert.Equal(t, []string{"autolumin", "aquaminder"}, tok.Audience, "Unexpected audience on the token")
+	assert.Equal(t, authTok.IssuedAt.Unix(), tok.IssuedAt.Unix(), "Unexpected iat on the token")
+	assert.Equal(t, "kneeru@gmail.com", tok.Claims.(jwt.MapClaims)["sub"], "Unexpected sub on the token")
+	assert.Equal(t, authTok.UUID, tok.Claims.(jwt.MapClaims)["jti"], "Unexpected jti on the token")
+
+	_, err = tokStr.Parse("secretstring", ExpectIssuer("https://auth.someother.in"))
+	assert.NotNil(t, err, "Was expecting error for unexpected issuer")
+	_, err = tokStr.Parse("secretstring", ExpectAudience("someotherproduct"))
+	assert.NotNil(t, err, "Was expecting error for unexpected audience")
+
+	// token that isnt valid yet
+	later := func(jt *JWTok) {
+		jt.NotBefore = time.Now().Add(1 * time.Minute)
+	}
+	tokStr, _ = NewToken("kneeru@gmail.com", 2, AuthExp, later).ToString("secretstring")
+	_, err = tokStr.Parse("secretstring")
+	assert.NotNil(t, err, "Was expecting error for token that isnt valid yet")
+	_, err = tokStr.Parse("secretstring", WithLeeway(2*time.Minute))
+	assert.Nil(t, err, "Unexpected error for token that is valid within leeway")
+
+	// token that has expired a moment ago is valid only within the leeway
+	tokStr, _ = NewToken("kneeru@gmail.com", 2, -2*time.Second).ToString("secretstring")
+	_, err = tokStr.Parse("secretstring")
+	assert.Nil(t, err, "Unexpected error for token that has expired within leeway")
+	_, err = tokStr.Parse("secretstring", WithLeeway(0))
+	assert.NotNil(t, err, "Was expecting error for expired token")
+}
+
+func TestClaimDecoding(t *testing.T) {
+	authTok := NewToken("kneeru@gmail.com", 2, AuthExp)
+	tokStr, _ := authTok.ToString("secretstring")
+	tok, err := tokStr.Parse("secretstring")
+	assert.Nil(t, err, "Unexpected error parsing the token")
+	assert.True(t, tok.Exp > 0 && tok.Exp <= AuthExp, "Unexpected exp %s restored on the token", tok.Exp)
+
+	// validly signed tokens but with missing/mistyped claims should not panic
+	data := []jwt.MapClaims{
+		{"role": 2, "uuid": "someuuid", "exp": time.Now().Add(AuthExp).Unix()},
+		{"user": 23, "role": 2, "uuid": "someuuid", "exp": time.Now().Add(AuthExp).Unix()},
+		{"user": "kneeru@gmail.com", "uuid": "someuuid", "exp": time.Now().Add(AuthExp).Unix()},
+		{"user": "kneeru@gmail.com", "role": "admin", "uuid": "someuuid", "exp": time.Now().Add(AuthExp).Unix()},
+		{"user": "kneeru@gmail.com", "role": 2.5, "uuid": "someuuid", "exp": time.Now().Add(AuthExp).Unix()},
+		{"user": "kneeru@gmail.com", "role": 2, "exp": time.Now().Add(AuthExp).Unix()},
+		{"user": "kneeru@gmail.com", "role": 2, "uuid": "someuuid"},
+		{"user": "kneeru@gmail.com", "role": 2, "uuid": "someuuid", "exp": "tomorrow"},
+		{"user": "kneeru@gmail.com", "role": 2, "uuid": "someuuid", "exp": time.Now().Add(AuthExp).Unix(), "aud": 42},
+		{"user": "kneeru@gmail.com", "role": 2, "uuid": "someuuid", "exp": time.Now().Add(AuthExp).Unix(), "iss": []string{"autolumin"}},
+	}
+	for _, claims := range data {
+		str, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte("secretstring"))
+		tok, err := TokenStr(str).Parse("secretstring")
+		assert.Nil(t, tok, "Was expecting token to be nil for claims %v", claims)
+		assert.True(t, errors.Is(err, ErrTokClaims), "Unexpected error %v for claims %v", err, claims)
+	}
+}
+
+func TestCustomClaims(t *testing.T) {
+	type devClaims struct {
+		Tenant string   `json:"tenant"`
+		Serial string   `json:"serial"`
+		Name   string   `json:"name"`
+		Zones  []string `json:"zones"`
+		Limit  int      `json:"limit"`
+	}
+	custom := map[string]interface{}{
+		"tenant": "eensymachines",
+		"serial": "000000007920365b",
+		"name":   "Niranjan Awati",
+		"zones":  []string{"north", "east"},
+		"limit":  12,
+		"user":   "someoneelse@gmail.com", // reserved claims cannot be overriden
+	}
+	tokStr, _ := NewToken("kneeru@gmail.com", 2, AuthExp, WithClaims(custom)).ToString("secretstring")
+	tok, err := tokStr.Parse("secretstring")
+	assert.Nil(t, err, "Unexpected error parsing token with custom claims")
+	assert.Equal(t, "kneeru@gmail.com", tok.User, "Custom claims should not override reserved claims")
+	assert.Equal(t, "eensymachines", tok.Custom["tenant"], "Unexpected custom claim on the token")
+	assert.Nil(t, tok.Custom["user"], "Reserved claims should not be in custom claims")
+	dc := devClaims{}
+	assert.Nil(t, tok.ClaimsInto(&dc), "Unexpected error reading custom claims into struct")
+	assert.Equal(t, devClaims{"eensymachines", "000000007920365b", "Niranjan Awati", []string{"north", "east"}, 12}, dc, "Unexpected custom claims after round trip")
+}
+
+func TestClientClaim(t *testing.T) {
+	tokStr, _ := NewToken("kneeru@gmail.com", 2, AuthExp, WithClient("device")).ToString("secretstring")
+	tok, err := tokStr.Parse("secretstring")
+	assert.Nil(t, err, "Unexpected error parsing token with client type")
+	assert.Equal(t, "device", tok.Client, "Unexpected client type on the token")
+	claims := jwt.MapClaims{}
+	_, _, err = new(jwt.Parser).ParseUnverified(string(tokStr), claims)
+	assert.Nil(t, err, "Unexpected error reading the raw claims")
+	assert.Equal(t, "device", claims["client_type"], "Client type should be a private claim")
+	assert.Nil(t, claims["client_id"], "Client type should not take the registered client_id claim")
+}
@@ -0,0 +1,295 @@
+package auth
+
+/*
+Services that verify the tokens on their own cannot know a token was logged out before it expired
+LogoutToken hence puts the jti on the denylist in the cache for the rest of the token life, and publishes it on DenyChannel
+Denylist is the in-process subscriber - a bounded set of the jtis, loaded from the cache at start and kept up over pub/sub
+when full, live jtis that make way are still denied - the cache is asked for them till they would have expired
+pub/sub does not hold messages for a subscriber that is away, the denylist is loaded again each time it resubscribes
+wrap the verifier with Denying and the revoked tokens fail to parse, without a round trip to the cache per request
+sessions revoked as a whole - revoked by the user or an admin, evicted over the limit, or on refresh token reuse - are denied too
+the scripts that revoke them put their tokens on the denylist in the cache, which are then published as on logout
+*/
+
+import (
+	"container/list"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	ex "github.com/eensymachines-in/errx"
+	"github.com/go-redis/redis/v7"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// denyPrefix : cache keys for the jtis on the denylist
+	denyPrefix = "deny:"
+	// DenyChannel : pub/sub channel the jtis are published on as they are denied
+	DenyChannel = "auth:deny"
+)
+
+// denyKey : cache key that has the jti of the user on the denylist
+func denyKey(email, jti string) string {
+	return denyPrefix + slotTag(email) + jti
+}
+
+// denyJti : jti from the denylist key
+func denyJti(key string) string {
+	key = strings.TrimPrefix(key, denyPrefix)
+	if i := strings.Index(key, "}"); i >= 0 {
+		return key[i+1:]
+	}
+	return key
+}
+
+// denyMsg : message on the channel, time the token expires in unix milliseconds and the jti
+func denyMsg(jti string, exp time.Time) string {
+	return fmt.Sprintf("%d %s", exp.UnixNano()/int64(time.Millisecond), jti)
+}
+
+// publishDenied : publishes the jtis a script put on the denylist, to the Denylist subscribers
+// res is the result of the script, the jti, ttl in milliseconds pairs are in the tables nested in it
+// the denylist keys are already set, when publishing fails the subscribers miss the jtis till they load again
+// ErrCacheQuery : cache could not be queried
+func (tc *TokenCache) publishDenied(res []interface{}, ctx string) error {
+	now := time.Now()
+	pipe := tc.Client.Pipeline()
+	n := 0
+	for _, v := range res {
+		pairs, ok := v.([]interface{})
+		if !ok {
+			continue
+		}
+		for i := 0; i+1 < len(pairs); i += 2 {
+			jti, _ := pairs[i].(string)
+			ttl, _ := pairs[i+1].(int64)
+			pipe.Publish(DenyChannel, denyMsg(jti, now.Add(time.Duration(ttl)*time.Millisecond)))
+			n++
+		}
+	}
+	if n == 0 {
+		return nil
+	}
+	if _, err := pipe.Exec(); err != nil {
+		log.Warnf("denylist: failed to publish %d revoked tokens %s", n, err)
+		return ex.NewErr(&ex.ErrCacheQuery{}, err, "Failed to publish revoked tokens", ctx+"/pipe.Exec()")
+	}
+	return nil
+}
+
+// denyItem : jti on the denylist, till the token expires
+type denyItem struct {
+	jti string
+	exp time.Time
+}
+
+// Denylist : in-process set of the jtis logged out, kept up with the cache over pub/sub
+// when full the expired jtis make way first, then the oldest denied - those are then looked up in the cache
+// size it for the logouts expected within the longest token lifetime, so that it seldom has to
+type Denylist struct {
+	Client redis.UniversalClient
+	Size   int // most jtis held
+	mu     sync.Mutex
+	items  map[string]*list.Element
+	order  *list.List // oldest denied first
+	spill  time.Time  // live jtis made way till this time, a jti not in the list is then looked up in the cache
+	pubsub *redis.PubSub
+}
+
+// NewDenylist : empty denylist, call Listen to have it kept up with the cache
+func NewDenylist(client redis.UniversalClient, size int) *Denylist {
+	return &Denylist{Client: client, Size: size, items: map[string]*list.Element{}, order: list.New()}
+}
+
+// Add : denies the jti till the time the token expires
+func (dl *Denylist) Add(jti string, exp time.Time) {
+	now := time.Now()
+	if !now.Before(exp) {
+		return
+	}
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+	if el, ok := dl.items[jti]; ok {
+		el.Value.(*denyItem).exp = exp
+		return
+	}
+	dl.items[jti] = dl.order.PushBack(&denyItem{jti: jti, exp: exp})
+	if dl.Size <= 0 || dl.order.Len() <= dl.Size {
+		return
+	}
+	for el := dl.order.Front(); el != nil; {
+		next := el.Next()
+		if item := el.Value.(*denyItem); !now.Before(item.exp) {
+			dl.order.Remove(el)
+			delete(dl.items, item.jti)
+		}
+		el = next
+	}
+	for dl.order.Len() > dl.Size {
+		oldest := dl.order.Remove(dl.order.Front()).(*denyItem)
+		delete(dl.items, oldest.jti)
+		if oldest.exp.After(dl.spill) {
+			dl.spill = oldest.exp
+		}
+	}
+}
+
+// Denied : true when the jti of the user is on the denylist, and the token is yet to expire
+// jtis that made way for the newer ones are looked up in the cache
+// ErrCacheQuery : cache could not be queried
+func (dl *Denylist) Denied(email, jti string) (bool, error) {
+	now := time.Now()
+	dl.mu.Lock()
+	el, ok := dl.items[jti]
+	if ok && !now.Before(el.Value.(*denyItem).exp) {
+		dl.order.Remove(el)
+		delete(dl.items, jti)
+		ok = false
+	}
+	spilt := now.Before(dl.spill)
+	dl.mu.Unlock()
+	if ok || !spilt {
+		return ok, nil
+	}
+	n, err := dl.Client.Exists(denyKey(email, jti)).Result()
+	if err != nil {
+		return false, ex.NewErr(&ex.ErrCacheQuery{}, err, "Failed to check the denylist", "Denylist.Denied/dl.Client.Exists()")
+	}
+	return n > 0, nil
+}
+
+// Listen : subscribes to DenyChannel and then loads the denylist from the cache
+// subscribed first so that no jti denied in between is missed, messages are then taken in till Close
+// on a reconnect the denylist is loaded again, for the jtis denied while it was away
+// ErrCacheQuery : cache could not be queried
+func (dl *Denylist) Listen() error {
+	ps := dl.Client.Subscribe(DenyChannel)
+	if _, err := ps.Receive(); err != nil {
+		ps.Close()
+		return ex.NewErr(&ex.ErrCacheQuery{}, err, "Failed to subscribe to the denylist", "Denylist.Listen/ps.Receive()")
+	}
+	dl.pubsub = ps
+	go dl.receive(ps.ChannelWithSubscriptions(100))
+	return dl.loadAll()
+}
+
+// loadAll : adds the jtis on the denylist in the cache, from all the masters when a cluster
+// ErrCacheQuery : cache could not be queried
+func (dl *Denylist) loadAll() error {
+	if cc, ok := dl.Client.(*redis.ClusterClient); ok {
+		// keys are spread over the masters, each is scanned
+		return cc.ForEachMaster(func(c *redis.Client) error {
+			return dl.load(c)
+		})
+	}
+	return dl.load(dl.Client)
+}
+
+// load : adds the jtis on the denylist in the cache
+// ErrCacheQuery : cache could not be queried
+func (dl *Denylist) load(c redis.Cmdable) error {
+	iter := c.Scan(0, denyPrefix+"*", 100).Iterator()
+	for iter.Next() {
+		ttl, err := c.PTTL(iter.Val()).Result()
+		if err != nil {
+			return ex.NewErr(&ex.ErrCacheQuery{}, err, "Failed to load the denylist", "Denylist.load/c.PTTL()")
+		}
+		if ttl > 0 {
+			dl.Add(denyJti(iter.Val()), time.Now().Add(ttl))
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return ex.NewErr(&ex.ErrCacheQuery{}, err, "Failed to load the denylist", "Denylist.load/iter.Next()")
+	}
+	return nil
+}
+
+// receive : adds the jtis from the channel, till the channel closes
+// subscription on the channel is after a reconnect, the denylist is loaded again
+func (dl *Denylist) receive(msgs <-chan interface{}) {
+	for m := range msgs {
+		if _, ok := m.(*redis.Subscription); ok {
+			if err := dl.loadAll(); err != nil {
+				log.Warnf("denylist: failed to load after reconnect %s", err)
+			}
+			continue
+		}
+		msg, ok := m.(*redis.Message)
+		if !ok {
+			continue
+		}
+		parts := strings.SplitN(msg.Payload, " ", 2)
+		if len(parts) != 2 {
+			log.Warnf("denylist: unexpected message %q", msg.Payload)
+			continue
+		}
+		ms, err := strconv.ParseInt(parts[0], 10, 64)
+		if err != nil {
+			log.Warnf("denylist: unexpected message %q", msg.Payload)
+			continue
+		}
+		dl.Add(parts[1], time.Unix(0, ms*int64(time.Millisecond)))
+	}
+}
+
+// Close : unsubscribes, the denylist is no longer kept up
+func (dl *Denylist) Close() error {
+	if dl.pubsub == nil {
+		return nil
+	}
+	return dl.pubsub.Close()
+}
+
+// denyVerifier : verifies with the inner verifier, then checks the jti on the denylist
+type denyVerifier struct {
+	inner Verifier
+	dl    *Denylist
+}
+
+// Denying : verifier that rejects the tokens on the denylist, with ErrTokRevoked
+func Denying(v Verifier, dl *Denylist) ClaimsVerifier {
+	return &denyVerifier{inner: v, dl: dl}
+}
+
+// VerifyKey : key from the inner verifier
+func (dv *denyVerifier) VerifyKey(tok *jwt.Token) (interface{}, error) {
+	return dv.inner.VerifyKey(tok)
+}
+
+// verifyToken : verifies with the inner verifier, then checks the jti
+func (dv *denyVerifier) verifyToken(ts TokenStr) (*jwt.Token, error) {
+	tok, err := verifyToken(ts, dv.inner)
+	if err != nil {
+		return nil, err
+	}
+	claims, ok := tok.Claims.(jwt.MapClaims)
+	if !ok {
+		return tok, nil
+	}
+	jti, _ := claims["jti"].(string)
+	if jti == "" {
+		return tok, nil
+	}
+	user, _ := claims["user"].(string)
+	denied, err := dv.dl.Denied(user, jti)
+	if err != nil {
+		return nil, err
+	}
+	if denied {
+		return nil, newTokErr(ErrTokRevoked, nil, "denyVerifier.verifyToken")
+	}
+	return tok, nil
+}
+
+// VerifyClaims : verifies with the inner verifier, then checks the jti
+func (dv *denyVerifier) VerifyClaims(ts TokenStr) (jwt.MapClaims, error) {
+	tok, err := dv.verifyToken(ts)
+	if err != nil {
+		return nil, err
+	}
+	return tok.Claims.(jwt.MapClaims), nil
+}
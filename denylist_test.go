@@ -0,0 +1,131 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	ex "github.com/eensymachines-in/errx"
+	"github.com/go-redis/redis/v7"
+	"github.com/stretchr/testify/assert"
+)
+
+// denied : Denied on a denylist that need not ask the cache
+func denied(dl *Denylist, jti string) bool {
+	result, _ := dl.Denied("", jti)
+	return result
+}
+
+func TestDenylistSize(t *testing.T) {
+	dl := NewDenylist(nil, 2)
+	later := time.Now().Add(time.Minute)
+	dl.Add("first", later)
+	dl.Add("expired", time.Now().Add(-1*time.Second))
+	assert.True(t, denied(dl, "first"), "Was expecting the jti denied")
+	assert.False(t, denied(dl, "expired"), "Expired token need not be denied")
+	dl.Add("soon", time.Now().Add(50*time.Millisecond))
+	<-time.After(100 * time.Millisecond)
+	assert.False(t, denied(dl, "soon"), "Jti should not be denied past the token life")
+	dl.Add("gone", time.Now().Add(50*time.Millisecond))
+	<-time.After(100 * time.Millisecond)
+	dl.Add("second", later)
+	// expired jti makes way, the live ones stay
+	assert.True(t, denied(dl, "first"), "Live jti should not make way for another while one has expired")
+	assert.True(t, denied(dl, "second"), "Was expecting the jti denied")
+	assert.True(t, dl.spill.IsZero(), "No live jti should have made way")
+}
+
+func TestDenylist(t *testing.T) {
+	cac := testCache(t)
+	defer cac.Close()
+	dl := NewDenylist(cac.Client, 100)
+	assert.Nil(t, dl.Listen(), "Unexpected error listening to the denylist")
+	defer dl.Close()
+	v := Denying(NewHMACVerifier("secretstring"), dl)
+
+	email := fmt.Sprintf("denylist%d@gmail.com", time.Now().UnixNano())
+	pair := &TokenPair{}
+	assert.Nil(t, cac.LoginUser(email, 2, pair), "Unexpected error logging in")
+	tokStr, _ := pair.Auth.ToString("secretstring")
+	_, err := tokStr.ParseWith(v)
+	assert.Nil(t, err, "Unexpected error parsing token not yet logged out")
+
+	assert.Nil(t, cac.LogoutToken(pair.Auth), "Unexpected error logging out")
+	for i := 0; i < 20 && !denied(dl, pair.Auth.UUID); i++ {
+		<-time.After(50 * time.Millisecond)
+	}
+	_, err = tokStr.ParseWith(v)
+	assert.True(t, errors.Is(err, ErrTokRevoked), "Unexpected error %v parsing token logged out", err)
+	te, ok := err.(*TokErr)
+	if assert.True(t, ok, "Was expecting a TokErr") {
+		assert.Equal(t, 401, te.HTTPStatusCode(), "Unexpected status code for revoked token")
+	}
+
+	// denylist started after the logout loads it from the cache
+	late := NewDenylist(cac.Client, 100)
+	assert.Nil(t, late.Listen(), "Unexpected error listening to the denylist")
+	defer late.Close()
+	// many jtis in the cache, the ones that make way are checked in the cache by the user
+	ok, err = late.Denied(email, pair.Auth.UUID)
+	assert.True(t, ok && err == nil, "Was expecting the jti loaded from the cache")
+
+	// live jtis that make way on a full denylist are still denied, from the cache
+	full := NewDenylist(cac.Client, 1)
+	for i := 0; i < 3; i++ {
+		assert.Nil(t, cac.LoginUser(email, 2, pair), "Unexpected error logging in")
+		assert.Nil(t, cac.LogoutToken(pair.Auth), "Unexpected error logging out")
+		full.Add(pair.Auth.UUID, time.Now().Add(pair.Auth.Exp))
+		if i == 0 {
+			tokStr, _ = pair.Auth.ToString("secretstring")
+		}
+	}
+	assert.Equal(t, 1, full.order.Len(), "Unexpected count of jtis held")
+	_, err = tokStr.ParseWith(Denying(NewHMACVerifier("secretstring"), full))
+	assert.True(t, errors.Is(err, ErrTokRevoked), "Unexpected error %v parsing token that made way", err)
+	ok, err = full.Denied(email, "notdenied")
+	assert.False(t, ok || err != nil, "Unexpected denial %v for a jti never denied", err)
+	down := NewDenylist(redis.NewClient(&redis.Options{Addr: "localhost:1"}), 1)
+	down.Add("first", time.Now().Add(time.Minute))
+	down.Add("second", time.Now().Add(time.Minute))
+	_, err = down.Denied(email, "first")
+	_, ok = err.(*ex.ErrCacheQuery)
+	assert.True(t, ok, "Unexpected error %v when the cache is down", err)
+
+	// tokens of the sessions revoked as a whole are denied too
+	wait := func(jti string) bool {
+		for i := 0; i < 20 && !denied(dl, jti); i++ {
+			<-time.After(50 * time.Millisecond)
+		}
+		return denied(dl, jti)
+	}
+	assert.Nil(t, cac.LoginUser(email, 2, pair), "Unexpected error logging in")
+	assert.Nil(t, cac.RevokeSession(email, pair.Auth.Session), "Unexpected error revoking session")
+	assert.True(t, wait(pair.Auth.UUID), "Was expecting the auth token of the revoked session denied")
+	assert.True(t, wait(pair.Refr.UUID), "Was expecting the refr token of the revoked session denied")
+	assert.Nil(t, cac.LoginUser(email, 2, pair), "Unexpected error logging in")
+	assert.Nil(t, cac.RevokeAllSessions(email), "Unexpected error revoking sessions")
+	assert.True(t, wait(pair.Auth.UUID), "Was expecting the auth token denied when logged out everywhere")
+	cac.Policy = &TokenPolicy{Limit: SessionLimit{Max: 1, Policy: EvictOldest}}
+	assert.Nil(t, cac.LoginUser(email, 2, pair), "Unexpected error logging in")
+	evicted := pair.Auth.UUID
+	assert.Nil(t, cac.LoginUser(email, 2, pair), "Unexpected error logging in")
+	assert.True(t, wait(evicted), "Was expecting the auth token of the evicted session denied")
+	cac.Policy = nil
+	cac.OnEvent = func(*TokEvent) {}
+	assert.Nil(t, cac.RefreshUser(pair.Refr, &TokenPair{}), "Unexpected error refreshing")
+	assert.NotNil(t, cac.RefreshUser(pair.Refr, &TokenPair{}), "Was expecting the reuse caught")
+	assert.True(t, wait(pair.Auth.UUID), "Was expecting the auth token of the session revoked on reuse denied")
+
+	// jtis denied while away are loaded on the reconnect
+	away := NewDenylist(cac.Client, 100)
+	assert.Nil(t, cac.LoginUser(email, 2, pair), "Unexpected error logging in")
+	assert.Nil(t, cac.LogoutToken(pair.Auth), "Unexpected error logging out")
+	msgs := make(chan interface{}, 1)
+	msgs <- &redis.Subscription{Kind: "subscribe", Channel: DenyChannel, Count: 1}
+	close(msgs)
+	away.receive(msgs)
+	ok, err = away.Denied(email, pair.Auth.UUID)
+	assert.True(t, ok && err == nil, "Was expecting the jti loaded on reconnect")
+	cac.RevokeAllSessions(email)
+}
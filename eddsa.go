@@ -0,0 +1,62 @@
+package auth
+
+/*
+jwt-go v3 does not ship with EdDSA, this registers Ed25519 as a signing method
+so that tokens with the alg header "EdDSA" can be signed and verified like the others
+*/
+
+import (
+	"crypto/ed25519"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// SigningMethodEd25519 : EdDSA signing method over the Ed25519 curve
+// signs with ed25519.PrivateKey and verifies with ed25519.PublicKey
+type SigningMethodEd25519 struct{}
+
+// SigningMethodEdDSA : the one instance of the Ed25519 signing method, use this as jwt.SigningMethod
+var SigningMethodEdDSA *SigningMethodEd25519
+
+func init() {
+	SigningMethodEdDSA = &SigningMethodEd25519{}
+	jwt.RegisterSigningMethod(SigningMethodEdDSA.Alg(), func() jwt.SigningMethod {
+		return SigningMethodEdDSA
+	})
+}
+
+// Alg : name of the algorithm as it appears on the token header
+func (m *SigningMethodEd25519) Alg() string {
+	return "EdDSA"
+}
+
+// Sign : signs the signing string with the ed25519.PrivateKey
+func (m *SigningMethodEd25519) Sign(signingString string, key interface{}) (string, error) {
+	priv, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return "", jwt.ErrInvalidKeyType
+	}
+	if len(priv) != ed25519.PrivateKeySize {
+		return "", jwt.ErrInvalidKey
+	}
+	return jwt.EncodeSegment(ed25519.Sign(priv, []byte(signingString))), nil
+}
+
+// Verify : verifies the signature against the signing string with ed25519.PublicKey
+func (m *SigningMethodEd25519) Verify(signingString, signature string, key interface{}) error {
+	pub, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return jwt.ErrInvalidKeyType
+	}
+	if len(pub) != ed25519.PublicKeySize {
+		return jwt.ErrInvalidKey
+	}
+	sig, err := jwt.DecodeSegment(signature)
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(pub, []byte(signingString), sig) {
+		return jwt.ErrSignatureInvalid
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+package auth
+
+/*
+Events on the tokens that the AuthAPI would want to audit - reuse of a refresh token for instance
+stores emit them to the OnEvent func, when none is set they are logged
+*/
+
+import (
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// TokEventKind : what happened to the tokens
+type TokEventKind string
+
+const (
+	// EvtRefrReuse : refr token that was already rotated was presented again, the whole session was revoked
+	// either the client or an attacker holds a stolen token
+	EvtRefrReuse TokEventKind = "refr_reuse"
+	// EvtRefrRetry : refr token that was already rotated was presented again within the grace of the TokenPolicy
+	// taken for a retry, the pair issued before was replaced - a replay by an attacker within the grace looks the same
+	EvtRefrRetry TokEventKind = "refr_retry"
+	// EvtSessionEvicted : oldest session of the user was revoked to make way for a login, over the limit on sessions
+	EvtSessionEvicted TokEventKind = "session_evicted"
+)
+
+// TokEvent : event on the tokens of the user, for auditing
+type TokEvent struct {
+	Kind    TokEventKind
+	User    string
+	Session string // sid the tokens belong to
+	UUID    string // token the event is about
+	At      time.Time
+}
+
+// emitEvent : hands out the event to the func, logs it when there is none
+func emitEvent(fn func(*TokEvent), ev *TokEvent) {
+	ev.At = time.Now()
+	if fn != nil {
+		fn(ev)
+		return
+	}
+	log.WithFields(log.Fields{
+		"user":    ev.User,
+		"session": ev.Session,
+		"uuid":    ev.UUID,
+	}).Warnf("token event: %s", ev.Kind)
+}
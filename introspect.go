@@ -0,0 +1,190 @@
+package auth
+
+/*
+Token introspection (RFC 7662) for services that cannot verify tokens locally - edge gateways for instance
+AuthAPI mounts the handler, the token is parsed and then checked against the cache, so logged out tokens are inactive
+Gateways use the client, which caches the results for a bounded time so that not every request is a round trip
+Handler does not authenticate the caller, mount it behind the middleware that does
+https://datatracker.ietf.org/doc/html/rfc7662
+*/
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	ex "github.com/eensymachines-in/errx"
+)
+
+// Introspection : RFC 7662 introspection response
+// when the token is not active, none but Active is sent
+type Introspection struct {
+	Active   bool     `json:"active"`
+	Sub      string   `json:"sub,omitempty"`
+	Username string   `json:"username,omitempty"`
+	Scope    string   `json:"scope,omitempty"`
+	Exp      int64    `json:"exp,omitempty"`
+	Iat      int64    `json:"iat,omitempty"`
+	Nbf      int64    `json:"nbf,omitempty"`
+	Iss      string   `json:"iss,omitempty"`
+	Aud      []string `json:"aud,omitempty"`
+	Jti      string   `json:"jti,omitempty"`
+	Role     *int     `json:"role,omitempty"` // extension, role elevation of the user
+}
+
+// Scopes : scopes granted to the token
+func (in *Introspection) Scopes() []string {
+	return splitScopes(in.Scope)
+}
+
+// newIntrospection : active introspection response for the token
+func newIntrospection(tok *JWTok) *Introspection {
+	role := tok.Role
+	return &Introspection{
+		Active:   true,
+		Sub:      tok.User,
+		Username: tok.User,
+		Scope:    joinScopes(tok.Scopes),
+		Exp:      time.Now().Add(tok.Exp).Unix(),
+		Iat:      tok.IssuedAt.Unix(),
+		Nbf:      tok.NotBefore.Unix(),
+		Iss:      tok.Issuer,
+		Aud:      tok.Audience,
+		Jti:      tok.UUID,
+		Role:     &role,
+	}
+}
+
+// IntrospectionHandler : serves RFC 7662 introspection, token is posted as the form value "token"
+// tc : store the tokens are checked against, TokenCache or MemStore
+// v : verifies the token, NewHMACVerifier(secret) for tokens that TokenStr.Parse(secret) would parse
+// tokens that fail to parse, or arent in the cache any longer are inactive
+// so are refr tokens, a gateway is never to take them for auth tokens
+// when the cache cannot be queried the token is not reported inactive, the handler errs instead
+func IntrospectionHandler(tc TokenStore, v Verifier, opts ...ParseOption) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		tokStr := r.PostFormValue("token")
+		if tokStr == "" {
+			w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_request"})
+			return
+		}
+		result := &Introspection{}
+		if tok, err := TokenStr(tokStr).ParseWith(v, opts...); err == nil && tok.Use != UseRefr {
+			if err := tc.TokenStatus(tok); err == nil {
+				result = newIntrospection(tok)
+			} else if x, ok := err.(*ex.ErrCacheQuery); ok {
+				x.Log()
+				w.WriteHeader(x.HTTPStatusCode())
+				return
+			}
+		}
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		w.Header().Set("Cache-Control", "no-store")
+		if err := json.NewEncoder(w).Encode(result); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	})
+}
+
+// introspected : introspection result as cached on the client
+type introspected struct {
+	result *Introspection
+	until  time.Time
+}
+
+// IntrospectionClient : introspects tokens on the AuthAPI and caches the results
+// active results are cached for TTL but never beyond the token expiry, inactive results are cached for TTL
+// TTL bounds how long a logged out token may still be seen active
+type IntrospectionClient struct {
+	URL          string
+	TTL          time.Duration
+	Client       *http.Client
+	ClientID     string // basic auth for the introspection endpoint, when set
+	ClientSecret string
+	mu           sync.Mutex
+	cache        map[string]*introspected // by the hash of the token, tokens are not held in memory
+}
+
+// NewIntrospectionClient : client that introspects on the url and caches the results for ttl
+func NewIntrospectionClient(url string, ttl time.Duration) *IntrospectionClient {
+	return &IntrospectionClient{URL: url, TTL: ttl, Client: &http.Client{Timeout: 10 * time.Second}, cache: map[string]*introspected{}}
+}
+
+// cached : result from the cache if not stale, stale results are purged
+func (ic *IntrospectionClient) cached(key string) *Introspection {
+	ic.mu.Lock()
+	defer ic.mu.Unlock()
+	now := time.Now()
+	if c, ok := ic.cache[key]; ok && now.Before(c.until) {
+		return c.result
+	}
+	for k, c := range ic.cache {
+		if !now.Before(c.until) {
+			delete(ic.cache, k)
+		}
+	}
+	return nil
+}
+
+// store : caches the result for the TTL, active results not beyond the token expiry
+func (ic *IntrospectionClient) store(key string, result *Introspection) {
+	until := time.Now().Add(ic.TTL)
+	if result.Active && result.Exp != 0 {
+		if exp := time.Unix(result.Exp, 0); exp.Before(until) {
+			until = exp
+		}
+	}
+	ic.mu.Lock()
+	defer ic.mu.Unlock()
+	if ic.cache == nil {
+		ic.cache = map[string]*introspected{}
+	}
+	ic.cache[key] = &introspected{result: result, until: until}
+}
+
+// Introspect : gets the introspection for the token, from the cache when not stale
+// Active on the result tells if the token can be allowed, error is only when introspection could not be done
+// ErrConnFailed : AuthAPI could not be reached or responded with an error
+// ErrInvalid : response could not be read
+func (ic *IntrospectionClient) Introspect(ts TokenStr) (*Introspection, error) {
+	sum := sha256.Sum256([]byte(ts))
+	key := hex.EncodeToString(sum[:])
+	if result := ic.cached(key); result != nil {
+		return result, nil
+	}
+	req, err := http.NewRequest(http.MethodPost, ic.URL, strings.NewReader(url.Values{"token": {string(ts)}}.Encode()))
+	if err != nil {
+		return nil, ex.NewErr(&ex.ErrInvalid{}, err, "Failed to introspect token", "IntrospectionClient.Introspect/http.NewRequest()")
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if ic.ClientID != "" {
+		req.SetBasicAuth(ic.ClientID, ic.ClientSecret)
+	}
+	resp, err := ic.Client.Do(req)
+	if err != nil {
+		return nil, ex.NewErr(&ex.ErrConnFailed{}, err, "Failed to introspect token", "IntrospectionClient.Introspect/ic.Client.Do()")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, ex.NewErr(&ex.ErrConnFailed{}, nil, "Failed to introspect token", "IntrospectionClient.Introspect/resp.StatusCode")
+	}
+	result := &Introspection{}
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		return nil, ex.NewErr(&ex.ErrInvalid{}, err, "Failed to read token introspection", "IntrospectionClient.Introspect/json.Decode")
+	}
+	ic.store(key, result)
+	return result, nil
+}
@@ -0,0 +1,61 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIntrospection(t *testing.T) {
+	cac := testCache(t)
+	defer cac.Close()
+	srv := httptest.NewServer(IntrospectionHandler(cac, NewHMACVerifier("secretstring")))
+	defer srv.Close()
+
+	result := &TokenPair{}
+	assert.Nil(t, cac.LoginUser("kneeru@gmail.com", 2, result, LoginScopes("devices:lock")), "Unexpected error logging in")
+	tokStr, _ := result.Auth.ToString("secretstring")
+
+	client := NewIntrospectionClient(srv.URL, 1*time.Minute)
+	in, err := client.Introspect(tokStr)
+	assert.Nil(t, err, "Unexpected error introspecting token")
+	assert.True(t, in.Active, "Was expecting token to be active")
+	assert.Equal(t, "kneeru@gmail.com", in.Sub, "Unexpected sub on introspection")
+	assert.Equal(t, []string{"devices:lock"}, in.Scopes(), "Unexpected scopes on introspection")
+	assert.Equal(t, 2, *in.Role, "Unexpected role on introspection")
+	assert.Equal(t, result.Auth.UUID, in.Jti, "Unexpected jti on introspection")
+	assert.InDelta(t, time.Now().Add(AuthExp).Unix(), in.Exp, 2, "Unexpected exp on introspection")
+
+	refrStr, _ := result.Refr.ToString("secretstring")
+	in, err = client.Introspect(refrStr)
+	assert.Nil(t, err, "Unexpected error introspecting refr token")
+	assert.False(t, in.Active, "Refr token should not introspect active")
+	assert.Empty(t, in.Scope, "Inactive refr token should carry no scopes")
+
+	cac.LogoutToken(result.Auth)
+	in, _ = client.Introspect(tokStr)
+	assert.True(t, in.Active, "Was expecting cached introspection till the ttl")
+	in, err = NewIntrospectionClient(srv.URL, 1*time.Minute).Introspect(tokStr)
+	assert.Nil(t, err, "Unexpected error introspecting logged out token")
+	assert.False(t, in.Active, "Was expecting logged out token to be inactive")
+	cac.LogoutToken(result.Refr)
+
+	in, err = client.Introspect(TokenStr("notatoken"))
+	assert.Nil(t, err, "Unexpected error introspecting garbage")
+	assert.False(t, in.Active, "Was expecting garbage to be inactive")
+	other, _ := NewToken("kneeru@gmail.com", 2, AuthExp).ToString("wrongkey")
+	in, _ = client.Introspect(other)
+	assert.False(t, in.Active, "Was expecting token signed with another key to be inactive")
+
+	resp, err := http.PostForm(srv.URL, url.Values{})
+	assert.Nil(t, err, "Unexpected error posting to introspection")
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode, "Was expecting bad request when no token")
+	resp, _ = http.Get(srv.URL)
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode, "Was expecting only POST to be allowed")
+	_, err = NewIntrospectionClient("http://localhost:1", time.Minute).Introspect(tokStr)
+	assert.NotNil(t, err, "Was expecting error when introspection endpoint is down")
+}
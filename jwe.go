@@ -0,0 +1,231 @@
+package auth
+
+/*
+Signed tokens carry the claims in clear base64, user email included
+JWE (RFC 7516) wraps the signed token so that the claims are not readable in browser storage and logs
+Content is always encrypted A256GCM, the content key is either
+dir : the 32 byte shared key itself
+RSA-OAEP / RSA-OAEP-256 : random content key encrypted with the RSA public key, decrypted with the private key
+Encrypted wraps any Signer, Decrypting wraps any Verifier - so auth and refr tokens can be configured separately
+*/
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"hash"
+	"strings"
+
+	"github.com/dgrijalva/jwt-go"
+	ex "github.com/eensymachines-in/errx"
+)
+
+const (
+	// JWEDir : the shared key is the content key
+	JWEDir = "dir"
+	// JWERSAOAEP : content key encrypted with RSAES OAEP, SHA-1
+	JWERSAOAEP = "RSA-OAEP"
+	// JWERSAOAEP256 : content key encrypted with RSAES OAEP, SHA-256
+	JWERSAOAEP256 = "RSA-OAEP-256"
+	// jweEnc : content encryption, the only one supported
+	jweEnc = "A256GCM"
+)
+
+// jweHeader : protected header on the JWE
+type jweHeader struct {
+	Alg string `json:"alg"`
+	Enc string `json:"enc"`
+	Cty string `json:"cty,omitempty"`
+}
+
+// JWE : encrypts the signed token to a compact JWE and decrypts it back
+type JWE struct {
+	Alg  string          // JWEDir, JWERSAOAEP or JWERSAOAEP256
+	Key  []byte          // 32 byte key when dir
+	Pub  *rsa.PublicKey  // encrypts the content key when RSA-OAEP, nil when dir
+	Priv *rsa.PrivateKey // decrypts the content key when RSA-OAEP, nil when the service only encrypts
+}
+
+// NewDirJWE : JWE with the 32 byte shared key as the content key
+// ErrInvalid : key is not 32 bytes
+func NewDirJWE(key []byte) (*JWE, error) {
+	if len(key) != 32 {
+		return nil, ex.NewErr(&ex.ErrInvalid{}, nil, "Key for encrypting tokens has to be 32 bytes", "NewDirJWE")
+	}
+	return &JWE{Alg: JWEDir, Key: key}, nil
+}
+
+// NewRSAJWE : JWE with the content key encrypted RSA-OAEP, the private key can both encrypt and decrypt
+func NewRSAJWE(priv *rsa.PrivateKey) *JWE {
+	return &JWE{Alg: JWERSAOAEP, Pub: &priv.PublicKey, Priv: priv}
+}
+
+// oaepHash : hash function for the RSA-OAEP variant
+func (j *JWE) oaepHash() hash.Hash {
+	if j.Alg == JWERSAOAEP256 {
+		return sha256.New()
+	}
+	return sha1.New()
+}
+
+// Encrypt : encrypts the plain token to compact JWE
+func (j *JWE) Encrypt(plain []byte) (string, error) {
+	failed := func(e error, ctx string) error {
+		return ex.NewErr(&ex.ErrEncrypt{}, e, "Failed to get authentication token", ctx)
+	}
+	cek, encKey := j.Key, []byte{}
+	switch j.Alg {
+	case JWEDir:
+		if len(j.Key) != 32 {
+			return "", failed(nil, "JWE.Encrypt/len(j.Key)")
+		}
+	case JWERSAOAEP, JWERSAOAEP256:
+		if j.Pub == nil {
+			return "", failed(nil, "JWE.Encrypt/j.Pub")
+		}
+		cek = make([]byte, 32)
+		if _, err := rand.Read(cek); err != nil {
+			return "", failed(err, "JWE.Encrypt/rand.Read")
+		}
+		var err error
+		if encKey, err = rsa.EncryptOAEP(j.oaepHash(), rand.Reader, j.Pub, cek, nil); err != nil {
+			return "", failed(err, "JWE.Encrypt/rsa.EncryptOAEP")
+		}
+	default:
+		return "", failed(nil, "JWE.Encrypt/j.Alg")
+	}
+	h := &jweHeader{Alg: j.Alg, Enc: jweEnc}
+	if !strings.HasPrefix(string(plain), "v4.") {
+		h.Cty = "JWT" // nested jwt, PASETO has no content type registered
+	}
+	hdr, _ := json.Marshal(h)
+	protected := base64.RawURLEncoding.EncodeToString(hdr)
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return "", failed(err, "JWE.Encrypt/aes.NewCipher")
+	}
+	gcm, _ := cipher.NewGCM(block)
+	iv := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(iv); err != nil {
+		return "", failed(err, "JWE.Encrypt/rand.Read")
+	}
+	sealed := gcm.Seal(nil, iv, plain, []byte(protected))
+	ciphertext, tag := sealed[:len(sealed)-gcm.Overhead()], sealed[len(sealed)-gcm.Overhead():]
+	b64 := base64.RawURLEncoding.EncodeToString
+	return strings.Join([]string{protected, b64(encKey), b64(iv), b64(ciphertext), b64(tag)}, "."), nil
+}
+
+// Decrypt : decrypts the compact JWE back to the plain token
+// TokErr : ErrTokMalformed when it isnt a JWE, ErrTokAlgorithm when encrypted with another alg, ErrTokSignature when it fails to decrypt
+// or when the content key is not 32 bytes
+func (j *JWE) Decrypt(jwe string) ([]byte, error) {
+	parts := strings.Split(jwe, ".")
+	if len(parts) != 5 {
+		return nil, newTokErr(ErrTokMalformed, nil, "JWE.Decrypt")
+	}
+	segs := make([][]byte, 5)
+	for i, p := range parts {
+		seg, err := base64.RawURLEncoding.DecodeString(p)
+		if err != nil {
+			return nil, newTokErr(ErrTokMalformed, err, "JWE.Decrypt/base64.DecodeString")
+		}
+		segs[i] = seg
+	}
+	hdr := &jweHeader{}
+	if err := json.Unmarshal(segs[0], hdr); err != nil {
+		return nil, newTokErr(ErrTokMalformed, err, "JWE.Decrypt/json.Unmarshal")
+	}
+	if hdr.Alg != j.Alg || hdr.Enc != jweEnc {
+		return nil, newTokErr(ErrTokAlgorithm, nil, "JWE.Decrypt")
+	}
+	cek := j.Key
+	if j.Alg != JWEDir {
+		if j.Priv == nil {
+			return nil, newTokErr(ErrTokSignature, nil, "JWE.Decrypt/j.Priv")
+		}
+		var err error
+		if cek, err = rsa.DecryptOAEP(j.oaepHash(), rand.Reader, j.Priv, segs[1], nil); err != nil {
+			return nil, newTokErr(ErrTokSignature, err, "JWE.Decrypt/rsa.DecryptOAEP")
+		}
+	}
+	if len(cek) != 32 {
+		// A256GCM only, a shorter key would silently be AES-128
+		return nil, newTokErr(ErrTokSignature, nil, "JWE.Decrypt/len(cek)")
+	}
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, newTokErr(ErrTokSignature, err, "JWE.Decrypt/aes.NewCipher")
+	}
+	gcm, _ := cipher.NewGCM(block)
+	if len(segs[2]) != gcm.NonceSize() {
+		return nil, newTokErr(ErrTokMalformed, nil, "JWE.Decrypt/iv")
+	}
+	plain, err := gcm.Open(nil, segs[2], append(segs[3], segs[4]...), []byte(parts[0]))
+	if err != nil {
+		return nil, newTokErr(ErrTokSignature, err, "JWE.Decrypt/gcm.Open")
+	}
+	return plain, nil
+}
+
+// jweSigner : signs with the inner signer and then encrypts
+type jweSigner struct {
+	inner Signer
+	jwe   *JWE
+}
+
+// Encrypted : signer that encrypts what the inner signer signs
+func Encrypted(s Signer, j *JWE) Signer {
+	return &jweSigner{inner: s, jwe: j}
+}
+
+// Sign : signed and then encrypted token
+func (js *jweSigner) Sign(tok *jwt.Token) (string, error) {
+	signed, err := js.inner.Sign(tok)
+	if err != nil {
+		return "", err
+	}
+	return js.jwe.Encrypt([]byte(signed))
+}
+
+// jweVerifier : decrypts and then verifies with the inner verifier
+type jweVerifier struct {
+	inner Verifier
+	jwe   *JWE
+}
+
+// Decrypting : verifier that decrypts the token before the inner verifier verifies it
+// tokens that arent encrypted are verified as they are
+func Decrypting(v Verifier, j *JWE) ClaimsVerifier {
+	return &jweVerifier{inner: v, jwe: j}
+}
+
+// VerifyKey : tokens that arent encrypted are verified by the inner verifier
+func (jv *jweVerifier) VerifyKey(tok *jwt.Token) (interface{}, error) {
+	return jv.inner.VerifyKey(tok)
+}
+
+// verifyToken : decrypts if need be and verifies with the inner verifier, header of the inner token is retained
+func (jv *jweVerifier) verifyToken(ts TokenStr) (*jwt.Token, error) {
+	if strings.Count(string(ts), ".") != 4 {
+		return verifyToken(ts, jv.inner)
+	}
+	plain, err := jv.jwe.Decrypt(string(ts))
+	if err != nil {
+		return nil, err
+	}
+	return verifyToken(TokenStr(plain), jv.inner)
+}
+
+// VerifyClaims : decrypts if need be and verifies with the inner verifier
+func (jv *jweVerifier) VerifyClaims(ts TokenStr) (jwt.MapClaims, error) {
+	tok, err := jv.verifyToken(ts)
+	if err != nil {
+		return nil, err
+	}
+	return tok.Claims.(jwt.MapClaims), nil
+}
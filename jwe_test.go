@@ -0,0 +1,106 @@
+package auth
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJWE(t *testing.T) {
+	key := make([]byte, 32)
+	rand.Read(key)
+	dir, err := NewDirJWE(key)
+	assert.Nil(t, err, "Unexpected error making dir JWE")
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	oaep := NewRSAJWE(rsaKey)
+	oaep256 := &JWE{Alg: JWERSAOAEP256, Pub: &rsaKey.PublicKey, Priv: rsaKey}
+	edPub, edPriv, _ := ed25519.GenerateKey(rand.Reader)
+	data := []struct {
+		desc string
+		s    Signer
+		v    Verifier
+	}{
+		{"dir HS256", Encrypted(NewHMACSigner("secretstring"), dir), Decrypting(NewHMACVerifier("secretstring"), dir)},
+		{"RSA-OAEP EdDSA", Encrypted(NewEdSigner(edPriv), oaep), Decrypting(NewEdVerifier(edPub), oaep)},
+		{"RSA-OAEP-256 EdDSA", Encrypted(NewEdSigner(edPriv), oaep256), Decrypting(NewEdVerifier(edPub), oaep256)},
+		{"dir PASETO", Encrypted(NewPasetoPublic(edPriv), dir), Decrypting(NewPasetoPublicVerifier(edPub), dir)},
+	}
+	for _, d := range data {
+		refrTok := NewToken("kneeru@gmail.com", 2, RefrExp)
+		tokStr, err := refrTok.SignWith(d.s)
+		assert.Nil(t, err, "Unexpected error encrypting token: %s", d.desc)
+		assert.Equal(t, 5, len(strings.Split(string(tokStr), ".")), "Unexpected token, not a compact JWE: %s", d.desc)
+		tok, err := tokStr.ParseWith(d.v)
+		assert.Nil(t, err, "Unexpected error decrypting token: %s", d.desc)
+		assert.Equal(t, "kneeru@gmail.com", tok.User, "Unexpected user on decrypted token: %s", d.desc)
+		assert.Equal(t, refrTok.UUID, tok.UUID, "Unexpected uuid on decrypted token: %s", d.desc)
+		// tampered ciphertext
+		parts := strings.Split(string(tokStr), ".")
+		if parts[3][0] == 'A' {
+			parts[3] = "B" + parts[3][1:]
+		} else {
+			parts[3] = "A" + parts[3][1:]
+		}
+		_, err = TokenStr(strings.Join(parts, ".")).ParseWith(d.v)
+		assert.NotNil(t, err, "Was expecting error for tampered JWE: %s", d.desc)
+	}
+	// tokens that are not encrypted are verified as they are
+	tokStr, _ := NewToken("kneeru@gmail.com", 2, AuthExp).ToString("secretstring")
+	_, err = tokStr.ParseWith(Decrypting(NewHMACVerifier("secretstring"), dir))
+	assert.Nil(t, err, "Unexpected error for token that isnt encrypted")
+	// encrypted with another key
+	otherKey := make([]byte, 32)
+	rand.Read(otherKey)
+	other, _ := NewDirJWE(otherKey)
+	tokStr, _ = NewToken("kneeru@gmail.com", 2, AuthExp).SignWith(Encrypted(NewHMACSigner("secretstring"), other))
+	_, err = tokStr.ParseWith(Decrypting(NewHMACVerifier("secretstring"), dir))
+	assert.True(t, errors.Is(err, ErrTokSignature), "Unexpected error %v for token encrypted with another key", err)
+	// encrypted with another alg
+	_, err = tokStr.ParseWith(Decrypting(NewHMACVerifier("secretstring"), oaep))
+	assert.True(t, errors.Is(err, ErrTokAlgorithm), "Unexpected error %v for token encrypted with another alg", err)
+
+	// auth and refr tokens configured separately
+	pair := &TokenPair{Auth: NewToken("kneeru@gmail.com", 2, AuthExp), Refr: NewToken("kneeru@gmail.com", 2, RefrExp)}
+	m := pair.MarshalableWith(NewHMACSigner("authsecret"), Encrypted(NewHMACSigner("refrsecret"), dir)).(map[string]string)
+	assert.Equal(t, 3, len(strings.Split(m["auth"], ".")), "Auth token was not expected to be encrypted")
+	assert.Equal(t, 5, len(strings.Split(m["refr"], ".")), "Refr token was expected to be encrypted")
+}
+
+// aes128JWE : compact JWE that claims A256GCM but is sealed with the 16 byte key
+func aes128JWE(alg string, key, encKey []byte) string {
+	b64 := base64.RawURLEncoding.EncodeToString
+	protected := b64([]byte(`{"alg":"` + alg + `","enc":"A256GCM"}`))
+	block, _ := aes.NewCipher(key)
+	gcm, _ := cipher.NewGCM(block)
+	iv := make([]byte, gcm.NonceSize())
+	sealed := gcm.Seal(nil, iv, []byte("plain"), []byte(protected))
+	n := len(sealed) - gcm.Overhead()
+	return strings.Join([]string{protected, b64(encKey), b64(iv), b64(sealed[:n]), b64(sealed[n:])}, ".")
+}
+
+func TestJWEKeySize(t *testing.T) {
+	key := make([]byte, 16)
+	rand.Read(key)
+	_, err := NewDirJWE(key)
+	assert.NotNil(t, err, "Was expecting error for 16 byte key")
+	short := &JWE{Alg: JWEDir, Key: key}
+	_, err = short.Encrypt([]byte("plain"))
+	assert.NotNil(t, err, "Was expecting error encrypting with 16 byte key")
+	_, err = short.Decrypt(aes128JWE(JWEDir, key, nil))
+	assert.True(t, errors.Is(err, ErrTokSignature), "Unexpected error %v decrypting with 16 byte key", err)
+
+	// content key of 16 bytes under RSA-OAEP
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	encKey, _ := rsa.EncryptOAEP(sha1.New(), rand.Reader, &rsaKey.PublicKey, key, nil)
+	_, err = NewRSAJWE(rsaKey).Decrypt(aes128JWE(JWERSAOAEP, key, encKey))
+	assert.True(t, errors.Is(err, ErrTokSignature), "Unexpected error %v for 16 byte content key", err)
+}
@@ -0,0 +1,251 @@
+package auth
+
+/*
+Public keys from the keyring are published as a JWKS document (RFC 7517)
+services that verify tokens fetch the document, cache the keys and refresh them periodically
+HMAC secrets are never published - they arent public keys
+*/
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	ex "github.com/eensymachines-in/errx"
+)
+
+const (
+	// jwksCooldown : least time between 2 fetches when tokens come in with unknown kid
+	jwksCooldown = 5 * time.Second
+)
+
+// JWK : a single json web key, public keys only
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg,omitempty"`
+	Use string `json:"use,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// JWKSet : the JWKS document as served over http
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+// NewJWK : makes the json web key from the public key of the verifier
+// ErrInvalid : the verifier does not have a public key that can be published
+func NewJWK(kid string, v *KeyVerifier) (*JWK, error) {
+	b64 := base64.RawURLEncoding.EncodeToString
+	result := &JWK{Kid: kid, Alg: v.Method.Alg(), Use: "sig"}
+	switch key := v.Key.(type) {
+	case *rsa.PublicKey:
+		result.Kty = "RSA"
+		result.N = b64(key.N.Bytes())
+		result.E = b64(big.NewInt(int64(key.E)).Bytes())
+	case *ecdsa.PublicKey:
+		if key.Curve != elliptic.P256() {
+			return nil, ex.NewErr(&ex.ErrInvalid{}, nil, "Only P-256 keys can be published", "NewJWK")
+		}
+		result.Kty = "EC"
+		result.Crv = "P-256"
+		result.X = b64(key.X.FillBytes(make([]byte, 32)))
+		result.Y = b64(key.Y.FillBytes(make([]byte, 32)))
+	case ed25519.PublicKey:
+		result.Kty = "OKP"
+		result.Crv = "Ed25519"
+		result.X = b64(key)
+	default:
+		return nil, ex.NewErr(&ex.ErrInvalid{}, nil, "Key cannot be published", "NewJWK")
+	}
+	return result, nil
+}
+
+// Verifier : reads the public key from the json web key into a verifier
+// ErrInvalid : key type/curve is unsupported or the key is malformed
+func (k *JWK) Verifier() (*KeyVerifier, error) {
+	b64 := base64.RawURLEncoding.DecodeString
+	invalid := func(e error) error {
+		return ex.NewErr(&ex.ErrInvalid{}, e, fmt.Sprintf("Failed to read json web key %s", k.Kid), "JWK.Verifier")
+	}
+	result := &KeyVerifier{}
+	switch {
+	case k.Kty == "RSA":
+		n, err := b64(k.N)
+		if err != nil {
+			return nil, invalid(err)
+		}
+		e, err := b64(k.E)
+		if err != nil {
+			return nil, invalid(err)
+		}
+		result.Method = jwt.SigningMethodRS256
+		result.Key = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	case k.Kty == "EC" && k.Crv == "P-256":
+		x, err := b64(k.X)
+		if err != nil {
+			return nil, invalid(err)
+		}
+		y, err := b64(k.Y)
+		if err != nil {
+			return nil, invalid(err)
+		}
+		pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !pub.Curve.IsOnCurve(pub.X, pub.Y) {
+			return nil, invalid(nil)
+		}
+		result.Method = jwt.SigningMethodES256
+		result.Key = pub
+	case k.Kty == "OKP" && k.Crv == "Ed25519":
+		x, err := b64(k.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, invalid(err)
+		}
+		result.Method = SigningMethodEdDSA
+		result.Key = ed25519.PublicKey(x)
+	default:
+		return nil, invalid(nil)
+	}
+	if k.Alg != "" && k.Alg != result.Method.Alg() {
+		return nil, invalid(nil)
+	}
+	return result, nil
+}
+
+// JWKS : public keys on the keyring as a JWKS document, retiring keys are included
+// HMAC keys are left out
+func (kr *Keyring) JWKS() *JWKSet {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	result := &JWKSet{Keys: []JWK{}}
+	for kid, k := range kr.keys {
+		if jwk, err := NewJWK(kid, k.Verifier); err == nil {
+			result.Keys = append(result.Keys, *jwk)
+		}
+	}
+	return result
+}
+
+// JWKSHandler : serves the public keys on the keyring as a JWKS document
+// mount this on the AuthAPI, typically at /.well-known/jwks.json
+func JWKSHandler(kr *Keyring) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		w.Header().Set("Cache-Control", "public, max-age=300")
+		if err := json.NewEncoder(w).Encode(kr.JWKS()); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	})
+}
+
+// JWKSVerifier : verifies tokens with the public keys fetched from the JWKS url
+// keys are cached and fetched again once stale, or when a token comes in with a kid not seen before
+// one fetch at a time and outside the lock on the keys, verifications with the cached keys do not wait on the network
+type JWKSVerifier struct {
+	URL     string
+	Refresh time.Duration // duration for which the fetched keys are good
+	Client  *http.Client
+	mu      sync.Mutex // guards the keys, the time fetched and the error
+	fetchMu sync.Mutex // one fetch at a time, the others wait for it and take its keys
+	keys    map[string]*KeyVerifier
+	fetched time.Time
+	err     error // from the last fetch
+}
+
+// NewJWKSVerifier : verifier that fetches the keys from the url and refreshes them every so often
+func NewJWKSVerifier(url string, refresh time.Duration) *JWKSVerifier {
+	return &JWKSVerifier{URL: url, Refresh: refresh, Client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// fetch : gets the JWKS document from the url, keys that cannot be read are skipped
+func (jv *JWKSVerifier) fetch() (map[string]*KeyVerifier, error) {
+	resp, err := jv.Client.Get(jv.URL)
+	if err != nil {
+		return nil, ex.NewErr(&ex.ErrConnFailed{}, err, "Failed to get the public keys", "JWKSVerifier.fetch/jv.Client.Get()")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, ex.NewErr(&ex.ErrConnFailed{}, nil, "Failed to get the public keys", "JWKSVerifier.fetch/resp.StatusCode")
+	}
+	set := &JWKSet{}
+	if err := json.NewDecoder(resp.Body).Decode(set); err != nil {
+		return nil, ex.NewErr(&ex.ErrInvalid{}, err, "Failed to read the public keys", "JWKSVerifier.fetch/json.Decode")
+	}
+	keys := map[string]*KeyVerifier{}
+	for _, k := range set.Keys {
+		if v, err := k.Verifier(); err == nil {
+			keys[k.Kid] = v
+		}
+	}
+	return keys, nil
+}
+
+// refresh : fetches the keys again and replaces the cached ones, unless they were fetched after the time asked
+// callers that waited on a fetch in flight take its keys, or its error
+// when the fetch fails the cached keys are kept
+func (jv *JWKSVerifier) refresh(after time.Time) error {
+	jv.fetchMu.Lock()
+	defer jv.fetchMu.Unlock()
+	jv.mu.Lock()
+	if jv.fetched.After(after) {
+		defer jv.mu.Unlock()
+		return jv.err
+	}
+	jv.mu.Unlock()
+	keys, err := jv.fetch()
+	jv.mu.Lock()
+	defer jv.mu.Unlock()
+	jv.fetched, jv.err = time.Now(), err
+	if err == nil {
+		jv.keys = keys
+	}
+	return err
+}
+
+// lookup : cached key for the kid, and the time the keys were fetched
+func (jv *JWKSVerifier) lookup(kid string) (*KeyVerifier, bool, time.Time) {
+	jv.mu.Lock()
+	defer jv.mu.Unlock()
+	return jv.keys[kid], jv.keys != nil, jv.fetched
+}
+
+// VerifyKey : picks the public key by the kid on the token header
+// fetches the keys when stale, or when the kid is unknown - a key might have been rotated in
+// ErrConnFailed : keys could not be fetched and none are cached, the key server is down
+func (jv *JWKSVerifier) VerifyKey(tok *jwt.Token) (interface{}, error) {
+	kid, _ := tok.Header["kid"].(string)
+	now := time.Now()
+	k, cached, fetched := jv.lookup(kid)
+	if !cached || now.Sub(fetched) > jv.Refresh {
+		if err := jv.refresh(fetched); err != nil && !cached {
+			return nil, err
+		} // when the refresh fails the stale keys are used
+		k, _, fetched = jv.lookup(kid)
+	}
+	if k == nil && now.Sub(fetched) > jwksCooldown {
+		jv.refresh(fetched)
+		k, _, _ = jv.lookup(kid)
+	}
+	if k == nil {
+		return nil, newTokErr(ErrTokSignature, nil, "JWKSVerifier.VerifyKey")
+	}
+	return k.VerifyKey(tok)
+}
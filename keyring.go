@@ -0,0 +1,114 @@
+package auth
+
+/*
+Keyring lets the signing keys rotate without logging out every user.
+Only one key on the ring is active and signs the tokens, the others are retiring and only verify.
+Tokens are stamped with a kid header at signing, verification picks the key by the same kid.
+Rotation :
+1. Add the new key and Activate it - new tokens are now signed with it
+2. Tokens signed with the older key verify till they expire - the overlap window
+3. Remove the older key
+*/
+
+import (
+	"sync"
+
+	"github.com/dgrijalva/jwt-go"
+	ex "github.com/eensymachines-in/errx"
+)
+
+// RingKey : a key on the keyring identified by its kid
+type RingKey struct {
+	KID      string
+	Signer   *KeySigner   // can be nil on services that only verify
+	Verifier *KeyVerifier // verifies tokens stamped with this kid
+}
+
+// Keyring : set of keys indexed by kid, one of which is active and signs the tokens
+// Keyring is both a Signer and a Verifier, and is safe for concurrent use
+type Keyring struct {
+	mu     sync.RWMutex
+	keys   map[string]*RingKey
+	active string
+}
+
+// NewKeyring : makes an empty keyring, add and activate a key before signing
+func NewKeyring() *Keyring {
+	return &Keyring{keys: map[string]*RingKey{}}
+}
+
+// Add : adds the key to the ring for verification, key isnt used for signing till activated
+// ErrInvalid : key has no kid or verifier
+// ErrDuplicate : key with the same kid is already on the ring
+func (kr *Keyring) Add(k *RingKey) error {
+	if k == nil || k.KID == "" || k.Verifier == nil {
+		return ex.NewErr(&ex.ErrInvalid{}, nil, "Key to add on the keyring is invalid", "Keyring.Add")
+	}
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	if _, ok := kr.keys[k.KID]; ok {
+		return ex.NewErr(&ex.ErrDuplicate{}, nil, "Key with the same id is already on the keyring", "Keyring.Add")
+	}
+	kr.keys[k.KID] = k
+	return nil
+}
+
+// Activate : makes the key the one that signs, the previously active key is now retiring
+// ErrNotFound : no key with the kid on the ring
+// ErrInvalid : key cannot sign
+func (kr *Keyring) Activate(kid string) error {
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	k, ok := kr.keys[kid]
+	if !ok {
+		return ex.NewErr(&ex.ErrNotFound{}, nil, "Key to activate isnt on the keyring", "Keyring.Activate")
+	}
+	if k.Signer == nil {
+		return ex.NewErr(&ex.ErrInvalid{}, nil, "Key to activate cannot sign", "Keyring.Activate")
+	}
+	kr.active = kid
+	return nil
+}
+
+// Remove : drops the retiring key off the ring, tokens signed with it no longer verify
+// ErrInvalid : when trying to remove the active key
+func (kr *Keyring) Remove(kid string) error {
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	if kid == kr.active {
+		return ex.NewErr(&ex.ErrInvalid{}, nil, "Active key on the keyring cannot be removed", "Keyring.Remove")
+	}
+	delete(kr.keys, kid)
+	return nil
+}
+
+// Active : kid of the key that signs, empty if none activated yet
+func (kr *Keyring) Active() string {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	return kr.active
+}
+
+// Sign : signs with the active key and stamps its kid on the token header
+func (kr *Keyring) Sign(tok *jwt.Token) (string, error) {
+	kr.mu.RLock()
+	k, ok := kr.keys[kr.active]
+	kr.mu.RUnlock()
+	if !ok {
+		return "", ex.NewErr(&ex.ErrInvalid{}, nil, "No active key on the keyring to sign with", "Keyring.Sign")
+	}
+	tok.Header["kid"] = k.KID
+	return k.Signer.Sign(tok)
+}
+
+// VerifyKey : picks the key by the kid on the token header
+func (kr *Keyring) VerifyKey(tok *jwt.Token) (interface{}, error) {
+	kid, _ := tok.Header["kid"].(string)
+	kr.mu.RLock()
+	k, ok := kr.keys[kid]
+	kr.mu.RUnlock()
+	if !ok {
+		return nil, newTokErr(ErrTokSignature, nil, "Keyring.VerifyKey")
+	}
+	return k.Verifier.VerifyKey(tok)
+}
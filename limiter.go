@@ -0,0 +1,235 @@
+package auth
+
+/*
+Password guessing is slowed down by the LoginLimiter - failed logins are counted by the email and by the client IP
+every failure holds off the next attempt, for twice as long as the failure before
+after MaxFails consecutive failures the account is locked out, till the lockout lapses or an admin unlocks it
+the IP is shared by many users behind a NAT - its failures are only counted, it is locked out after IPMaxFails for IPLockout
+a successful login forgets the failures of the email, not of the IP - a valid account of its own does not clear an attacker
+once the account has failed Allow reserves the attempt, it is held off as if it were to fail - so guesses in parallel do not all get through
+Fail, Succeed or Release then settle the reservation with the outcome, the IP is never reserved
+ErrLoginLimited is what the API gets when an attempt is held off, it maps to 429
+*/
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	ex "github.com/eensymachines-in/errx"
+	"github.com/go-redis/redis/v7"
+)
+
+const (
+	// limPrefix : cache keys for the failed logins of the email, or the IP
+	limPrefix = "lim:"
+)
+
+// limEmailKey : cache key for the failed logins of the email
+func limEmailKey(email string) string {
+	return limPrefix + slotTag(email) + email
+}
+
+// limIPKey : cache key for the failed logins from the IP
+func limIPKey(ip string) string {
+	return limPrefix + "ip:" + ip
+}
+
+// ErrLoginLimited : login attempt held off after failed logins, maps to 429
+// set RetryAfter on the Retry-After header
+type ErrLoginLimited struct {
+	ex.Errx
+	RetryAfter time.Duration // till the next attempt is allowed
+	Locked     bool          // locked out after MaxFails failures, till the lockout lapses or Unlock
+}
+
+// HTTPStatusCode : too many requests
+func (el *ErrLoginLimited) HTTPStatusCode() int {
+	return http.StatusTooManyRequests
+}
+
+// LoginLimiter : counts the failed logins by the email and the IP, and holds off the attempts after
+type LoginLimiter struct {
+	Client     redis.UniversalClient
+	MaxFails   int           // consecutive failures of the account before the lockout
+	Backoff    time.Duration // hold off after the first failure, doubled for every failure after
+	Lockout    time.Duration // how long the lockout of the account lasts, the hold off is never longer
+	IPMaxFails int           // failures from the IP before its lockout, the IP is not held off till then
+	IPLockout  time.Duration // how long the lockout of the IP lasts
+	Window     time.Duration // failures are forgotten after this long without one
+}
+
+// NewLoginLimiter : limiter with the defaults - 5 failures, 1s backoff, 15m lockout, 50 failures from the IP, 15m IP lockout, 1h window
+func NewLoginLimiter(client redis.UniversalClient) *LoginLimiter {
+	return &LoginLimiter{Client: client, MaxFails: 5, Backoff: time.Second, Lockout: 15 * time.Minute, IPMaxFails: 50, IPLockout: 15 * time.Minute, Window: time.Hour}
+}
+
+// limitFail : counts the failure and holds off the next attempt
+// KEYS[1] is the failures of the email or the IP
+// ARGV : time now in unix milliseconds, backoff, lockout in milliseconds, max failures, window in milliseconds
+// with no backoff (the IP) the next attempt is not held off till the lockout
+// lockout that has lapsed starts the count over, returns the hold off in milliseconds and 1 when locked out
+var limitFail = redis.NewScript(`
+local now = tonumber(ARGV[1])
+if redis.call("HGET", KEYS[1], "locked") == "1" and tonumber(redis.call("HGET", KEYS[1], "until")) <= now then
+	redis.call("DEL", KEYS[1])
+end
+local fails = redis.call("HINCRBY", KEYS[1], "fails", 1)
+local lockout = tonumber(ARGV[3])
+local delay = math.floor(tonumber(ARGV[2]) * 2 ^ (fails - 1))
+local locked = 0
+if fails >= tonumber(ARGV[4]) then
+	delay = lockout
+	locked = 1
+elseif delay > lockout then
+	delay = lockout
+end
+redis.call("HSET", KEYS[1], "until", now + delay)
+redis.call("HSET", KEYS[1], "locked", locked)
+redis.call("HDEL", KEYS[1], "prev")
+local ttl = tonumber(ARGV[5])
+if delay > ttl then
+	ttl = delay
+end
+redis.call("PEXPIRE", KEYS[1], ttl)
+return {delay, locked}
+`)
+
+// limitAllow : reserves the attempt when it is not held off, it is then held off as if it were to fail
+// nothing is reserved while there are no failures, the hold off before the reservation is kept for the attempt to be released
+// lockout that has lapsed starts the count over, as with limitFail
+// KEYS[1] is the failures of the email
+// ARGV : time now in unix milliseconds, backoff, lockout in milliseconds, max failures
+// returns {0, 0} when allowed, else the hold off in milliseconds and 1 when locked out
+var limitAllow = redis.NewScript(`
+local now = tonumber(ARGV[1])
+local untl = tonumber(redis.call("HGET", KEYS[1], "until") or "0")
+local locked = redis.call("HGET", KEYS[1], "locked")
+if untl > now then
+	return {untl - now, tonumber(locked or "0")}
+end
+if locked == "1" then
+	redis.call("DEL", KEYS[1])
+	return {0, 0}
+end
+local fails = tonumber(redis.call("HGET", KEYS[1], "fails") or "0")
+if fails == 0 then
+	return {0, 0}
+end
+local lockout = tonumber(ARGV[3])
+local delay = math.floor(tonumber(ARGV[2]) * 2 ^ fails)
+if fails + 1 >= tonumber(ARGV[4]) or delay > lockout then
+	delay = lockout
+end
+redis.call("HSET", KEYS[1], "prev", untl)
+redis.call("HSET", KEYS[1], "until", now + delay)
+if redis.call("PTTL", KEYS[1]) < delay then
+	redis.call("PEXPIRE", KEYS[1], delay)
+end
+return {0, 0}
+`)
+
+// limitRelease : lets go of the reservation without counting the attempt, the hold off is as it was before
+// KEYS[1] is the failures of the email or the IP
+var limitRelease = redis.NewScript(`
+local prev = redis.call("HGET", KEYS[1], "prev")
+if prev then
+	redis.call("HSET", KEYS[1], "until", prev)
+	redis.call("HDEL", KEYS[1], "prev")
+end
+return 1
+`)
+
+// limited : error for the attempt held off, locked when the account or the IP is locked out
+func limited(wait, locked int64, msg, lockedMsg string) error {
+	if locked == 1 {
+		msg = lockedMsg
+	}
+	return &ErrLoginLimited{Errx: ex.NewErr(&ex.ErrLogin{}, nil, msg, "LoginLimiter.Allow"), RetryAfter: time.Duration(wait) * time.Millisecond, Locked: locked == 1}
+}
+
+// Allow : checks if the attempt to login can go ahead, call before the password is checked
+// the IP is only checked for the lockout, the attempt is reserved on the account once it has failed before
+// till the outcome is known with Fail, Succeed or Release the reserved attempt is held off as if it were to fail
+// ErrLoginLimited : attempt is held off, or the account / IP is locked out
+// ErrCacheQuery : cache could not be queried
+func (ll *LoginLimiter) Allow(email, ip string) error {
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	if ip != "" {
+		vals, err := ll.Client.HMGet(limIPKey(ip), "until", "locked").Result()
+		if err != nil {
+			return ex.NewErr(&ex.ErrCacheQuery{}, err, "Failed to check login attempts", "LoginLimiter.Allow/ll.Client.HMGet()")
+		}
+		untlStr, _ := vals[0].(string)
+		lockedStr, _ := vals[1].(string)
+		if untl, _ := strconv.ParseInt(untlStr, 10, 64); lockedStr == "1" && untl > now {
+			return limited(untl-now, 1, "", "Too many failed logins from the IP, try again later")
+		}
+	}
+	if email == "" {
+		return nil
+	}
+	val, err := limitAllow.Run(ll.Client, []string{limEmailKey(email)}, now, ll.Backoff.Milliseconds(), ll.Lockout.Milliseconds(), ll.MaxFails).Result()
+	if err != nil {
+		return ex.NewErr(&ex.ErrCacheQuery{}, err, "Failed to check login attempts", "LoginLimiter.Allow/limitAllow.Run()")
+	}
+	vals, _ := val.([]interface{})
+	wait, _ := vals[0].(int64)
+	locked, _ := vals[1].(int64)
+	if wait > 0 {
+		return limited(wait, locked, "Too many failed logins, try again later", "Account is locked after too many failed logins, try again later")
+	}
+	return nil
+}
+
+// Release : lets go of the attempt reserved by Allow without counting it, when it could not be checked at all
+// ErrCacheQuery : cache could not be queried
+func (ll *LoginLimiter) Release(email string) error {
+	if _, err := limitRelease.Run(ll.Client, []string{limEmailKey(email)}).Result(); err != nil {
+		return ex.NewErr(&ex.ErrCacheQuery{}, err, "Failed to release login attempt", "LoginLimiter.Release/limitRelease.Run()")
+	}
+	return nil
+}
+
+// Fail : counts the failed login against the email and the IP, either can be empty
+// ErrCacheQuery : cache could not be queried
+func (ll *LoginLimiter) Fail(email, ip string) error {
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	if email != "" {
+		_, err := limitFail.Run(ll.Client, []string{limEmailKey(email)}, now, ll.Backoff.Milliseconds(), ll.Lockout.Milliseconds(), ll.MaxFails, ll.Window.Milliseconds()).Result()
+		if err != nil {
+			return ex.NewErr(&ex.ErrCacheQuery{}, err, "Failed to count login attempt", "LoginLimiter.Fail/limitFail.Run()")
+		}
+	}
+	if ip != "" {
+		_, err := limitFail.Run(ll.Client, []string{limIPKey(ip)}, now, 0, ll.IPLockout.Milliseconds(), ll.IPMaxFails, ll.Window.Milliseconds()).Result()
+		if err != nil {
+			return ex.NewErr(&ex.ErrCacheQuery{}, err, "Failed to count login attempt", "LoginLimiter.Fail/limitFail.Run()")
+		}
+	}
+	return nil
+}
+
+// Succeed : forgets the failed logins of the email along with the reservation, those from the IP are kept
+// ErrCacheQuery : cache could not be queried
+func (ll *LoginLimiter) Succeed(email string) error {
+	return ll.Unlock(email)
+}
+
+// Unlock : forgets the failed logins of the email and lifts the lockout, for the admins
+// ErrCacheQuery : cache could not be queried
+func (ll *LoginLimiter) Unlock(email string) error {
+	if _, err := ll.Client.Del(limEmailKey(email)).Result(); err != nil {
+		return ex.NewErr(&ex.ErrCacheQuery{}, err, "Failed to unlock account", "LoginLimiter.Unlock/ll.Client.Del()")
+	}
+	return nil
+}
+
+// UnlockIP : forgets the failed logins from the IP and lifts the lockout, for the admins
+// ErrCacheQuery : cache could not be queried
+func (ll *LoginLimiter) UnlockIP(ip string) error {
+	if _, err := ll.Client.Del(limIPKey(ip)).Result(); err != nil {
+		return ex.NewErr(&ex.ErrCacheQuery{}, err, "Failed to unlock IP", "LoginLimiter.UnlockIP/ll.Client.Del()")
+	}
+	return nil
+}
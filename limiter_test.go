@@ -0,0 +1,193 @@
+package auth
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	ex "github.com/eensymachines-in/errx"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoginLimiter(t *testing.T) {
+	cac := testCache(t)
+	defer cac.Close()
+	lim := NewLoginLimiter(cac.Client)
+	lim.MaxFails, lim.Backoff, lim.Lockout = 3, 100*time.Millisecond, 600*time.Millisecond
+	lim.IPMaxFails, lim.IPLockout = 4, 600*time.Millisecond
+	email := fmt.Sprintf("limiter%d@gmail.com", time.Now().UnixNano())
+	ip := fmt.Sprintf("10.0.%d.1", time.Now().UnixNano()%250)
+	defer lim.UnlockIP(ip)
+
+	assert.Nil(t, lim.Allow(email, ip), "Was expecting the first attempt allowed")
+	assert.Nil(t, lim.Allow(email, ip), "Nothing should be held off while there are no failures")
+	assert.Nil(t, lim.Fail(email, ip), "Unexpected error counting failure")
+	err := lim.Allow(email, "")
+	el, ok := err.(*ErrLoginLimited)
+	if assert.True(t, ok, "Unexpected error %v after a failure", err) {
+		assert.Equal(t, http.StatusTooManyRequests, el.HTTPStatusCode(), "Unexpected status code")
+		assert.True(t, el.RetryAfter > 0 && el.RetryAfter <= 100*time.Millisecond, "Unexpected retry after %s", el.RetryAfter)
+		assert.False(t, el.Locked, "Account should not be locked after one failure")
+	}
+	// ip is not held off between the failures, the other accounts behind it go ahead
+	assert.Nil(t, lim.Allow("someoneelse@gmail.com", ip), "Was expecting the ip not held off")
+	<-time.After(120 * time.Millisecond)
+	assert.Nil(t, lim.Allow(email, ip), "Was expecting the attempt allowed after the backoff")
+	assert.Nil(t, lim.Fail(email, ip), "Unexpected error counting failure")
+	el, _ = lim.Allow(email, "").(*ErrLoginLimited)
+	if assert.NotNil(t, el, "Was expecting the attempt held off") {
+		assert.True(t, el.RetryAfter > 100*time.Millisecond, "Backoff should double, got %s", el.RetryAfter)
+	}
+
+	assert.Nil(t, lim.Fail(email, ip), "Unexpected error counting failure")
+	el, _ = lim.Allow(email, "").(*ErrLoginLimited)
+	if assert.NotNil(t, el, "Was expecting the account locked") {
+		assert.True(t, el.Locked, "Account should be locked after max failures")
+		assert.True(t, el.RetryAfter > 400*time.Millisecond, "Unexpected lockout %s", el.RetryAfter)
+	}
+	// ip is locked out on its own thresholds, for the other accounts too
+	assert.Nil(t, lim.Allow("someoneelse@gmail.com", ip), "Ip should not be locked before its own max failures")
+	assert.Nil(t, lim.Fail("", ip), "Unexpected error counting failure")
+	el, _ = lim.Allow("someoneelse@gmail.com", ip).(*ErrLoginLimited)
+	if assert.NotNil(t, el, "Was expecting the ip locked") {
+		assert.True(t, el.Locked, "Ip should be locked after its max failures")
+	}
+
+	assert.Nil(t, lim.Unlock(email), "Unexpected error unlocking account")
+	assert.Nil(t, lim.Allow(email, ""), "Was expecting the account unlocked")
+	assert.NotNil(t, lim.Allow(email, ip), "Unlocking the account should not unlock the ip")
+	assert.Nil(t, lim.UnlockIP(ip), "Unexpected error unlocking ip")
+	assert.Nil(t, lim.Allow(email, ip), "Was expecting the ip unlocked")
+
+	// once the account has failed the attempt is reserved till the outcome is known, one in parallel is held off
+	assert.Nil(t, lim.Fail(email, ""), "Unexpected error counting failure")
+	<-time.After(120 * time.Millisecond)
+	assert.Nil(t, lim.Allow(email, ip), "Was expecting the attempt allowed after the backoff")
+	el, _ = lim.Allow(email, ip).(*ErrLoginLimited)
+	if assert.NotNil(t, el, "Was expecting the attempt in parallel held off") {
+		assert.False(t, el.Locked, "Reserved attempt is not a lockout")
+	}
+	assert.Nil(t, lim.Release(email), "Unexpected error releasing attempt")
+	assert.Nil(t, lim.Allow(email, ip), "Released attempt should not be counted")
+	assert.Nil(t, lim.Release(email), "Unexpected error releasing attempt")
+
+	// lockout that has lapsed starts the count over
+	for i := 0; i < 3; i++ {
+		lim.Fail(email, "")
+	}
+	<-time.After(650 * time.Millisecond)
+	assert.Nil(t, lim.Allow(email, ""), "Was expecting the lockout lapsed")
+	assert.Nil(t, lim.Fail(email, ""), "Unexpected error counting failure")
+	el, _ = lim.Allow(email, "").(*ErrLoginLimited)
+	if assert.NotNil(t, el, "Was expecting the attempt held off") {
+		assert.False(t, el.Locked, "Count should start over after the lockout")
+	}
+	lim.Succeed(email)
+	assert.Nil(t, lim.Allow(email, ""), "Successful login should forget the failures")
+}
+
+func TestAuthenticateFrom(t *testing.T) {
+	cac := testCache(t)
+	defer cac.Close()
+	lim := NewLoginLimiter(cac.Client)
+	lim.MaxFails, lim.Backoff, lim.Lockout = 3, 200*time.Millisecond, time.Second
+	lim.IPMaxFails = 2
+	email := fmt.Sprintf("authfrom%d@gmail.com", time.Now().UnixNano())
+	ip := fmt.Sprintf("10.1.%d.1", time.Now().UnixNano()%250)
+	defer lim.UnlockIP(ip)
+	defer lim.Unlock(email)
+	acc := &UserAcc{Email: email, Passwd: "somepass"}
+	failing := func(err error) func(*UserAcc) (bool, error) {
+		return func(*UserAcc) (bool, error) { return false, err }
+	}
+
+	_, err := authLimited(failing(nil), nil, ip, lim)
+	_, ok := err.(*ex.ErrInvalid)
+	assert.True(t, ok, "Unexpected error %v for nil account", err)
+
+	// database failing is not the fault of the attempt
+	_, err = authLimited(failing(ex.NewErr(&ex.ErrQuery{}, nil, "gateway down", "test")), acc, ip, lim)
+	_, ok = err.(*ex.ErrQuery)
+	assert.True(t, ok, "Unexpected error %v when the database fails", err)
+	assert.Nil(t, lim.Allow(email, ip), "Failure of the database should not be counted")
+
+	// unregistered email is counted against the ip, not the email
+	_, err = authLimited(failing(ex.NewErr(&ex.ErrNotFound{}, nil, "not registered", "test")), acc, ip, lim)
+	_, ok = err.(*ex.ErrNotFound)
+	assert.True(t, ok, "Unexpected error %v for the unregistered account", err)
+	assert.Nil(t, lim.Allow(email, ""), "Unregistered email should not be counted against the email")
+	_, err = authLimited(failing(ex.NewErr(&ex.ErrNotFound{}, nil, "not registered", "test")), acc, ip, lim)
+	_, err = authLimited(failing(nil), &UserAcc{Email: "someoneelse@gmail.com"}, ip, lim)
+	_, ok = err.(*ErrLoginLimited)
+	assert.True(t, ok, "Unexpected error %v, was expecting the ip locked", err)
+	assert.Nil(t, lim.UnlockIP(ip), "Unexpected error unlocking ip")
+
+	// guesses in parallel after a failure, only one gets to check the password
+	var mu sync.Mutex
+	checked := 0
+	guess := func(*UserAcc) (bool, error) {
+		mu.Lock()
+		checked++
+		mu.Unlock()
+		<-time.After(50 * time.Millisecond)
+		return false, ex.NewErr(&ex.ErrLogin{}, nil, "mismatching password", "test")
+	}
+	authLimited(guess, acc, "", lim)
+	<-time.After(250 * time.Millisecond)
+	checked = 0
+	var wg sync.WaitGroup
+	limited := make(chan bool, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := authLimited(guess, acc, ip, lim)
+			_, ok := err.(*ErrLoginLimited)
+			limited <- ok
+		}()
+	}
+	wg.Wait()
+	close(limited)
+	held := 0
+	for ok := range limited {
+		if ok {
+			held++
+		}
+	}
+	assert.Equal(t, 1, checked, "Was expecting only one guess checked")
+	assert.Equal(t, 9, held, "Was expecting the other guesses held off")
+	el, _ := lim.Allow(email, "").(*ErrLoginLimited)
+	assert.NotNil(t, el, "Mismatching password should be counted against the email")
+	assert.Nil(t, lim.Allow("", ip), "Held off guesses should not be counted against the ip")
+	assert.Nil(t, lim.Fail("", ip), "Unexpected error counting failure")
+	assert.NotNil(t, lim.Allow("", ip), "Mismatching password should be counted against the ip")
+	assert.Nil(t, lim.UnlockIP(ip), "Unexpected error unlocking ip")
+
+	// many users behind the one ip login at once, none is held off
+	logins := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, err := authLimited(func(*UserAcc) (bool, error) {
+				<-time.After(50 * time.Millisecond)
+				return true, nil
+			}, &UserAcc{Email: fmt.Sprintf("shared%d-%s", i, email), Passwd: "somepass"}, ip, lim)
+			logins <- err
+		}(i)
+	}
+	wg.Wait()
+	close(logins)
+	for err := range logins {
+		assert.Nil(t, err, "Unexpected error for a login from the shared ip")
+	}
+
+	// success forgets the failures of the email
+	<-time.After(450 * time.Millisecond)
+	ok, err = authLimited(func(*UserAcc) (bool, error) { return true, nil }, acc, ip, lim)
+	assert.True(t, ok && err == nil, "Unexpected error %v authenticating", err)
+	assert.Nil(t, lim.Allow(email, ip), "Success should forget the failures and release the attempt")
+	assert.Nil(t, lim.Allow(email, ip), "Nothing should be reserved with the failures forgotten")
+}
@@ -0,0 +1,91 @@
+package auth
+
+/*
+One time tokens are for the links that are mailed out - password reset, email verification, invites
+short lived random strings bound to a purpose and a subject, they can be consumed once and only once
+they are not jwts nor references, no verifier would parse them and they cannot be used as auth tokens
+cache has only the hash of the token, so a dump of the cache has none that can be used
+*/
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"time"
+
+	ex "github.com/eensymachines-in/errx"
+	"github.com/go-redis/redis/v7"
+)
+
+const (
+	// oncePrefix : cache keys for the one time tokens
+	oncePrefix = "once:"
+	// onceLen : random bytes in a one time token
+	onceLen = 32
+)
+
+const (
+	// PurposeReset : one time token for the password reset
+	PurposeReset = "reset"
+	// PurposeVerify : one time token for the email verification
+	PurposeVerify = "verify"
+	// PurposeInvite : one time token for inviting a user
+	PurposeInvite = "invite"
+)
+
+// onceKey : cache key for the one time token of the purpose, by the hash of the token
+func onceKey(purpose, token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return oncePrefix + purpose + ":" + hex.EncodeToString(sum[:])
+}
+
+// consumeOnce : gets the subject of the one time token and deletes it, in one go
+// KEYS[1] is the one time token, returns nil when it has expired or was already consumed
+var consumeOnce = redis.NewScript(`
+local subject = redis.call("GET", KEYS[1])
+if subject then
+	redis.call("DEL", KEYS[1])
+end
+return subject
+`)
+
+// IssueOneTime : random url safe token for the purpose and the subject, good for one use within the ttl
+// subject is what the token is for - the email of the user to reset or invite
+// ErrInvalid : purpose or subject is empty, or the ttl is not positive
+// ErrEncrypt : token could not be generated
+// ErrCacheQuery : cache could not be queried
+func (tc *TokenCache) IssueOneTime(purpose, subject string, ttl time.Duration) (string, error) {
+	if purpose == "" || subject == "" || ttl <= 0 {
+		return "", ex.NewErr(&ex.ErrInvalid{}, nil, "Invalid purpose, subject or lifetime for the token", "TokenCache.IssueOneTime")
+	}
+	byt := make([]byte, onceLen)
+	if _, err := rand.Read(byt); err != nil {
+		return "", ex.NewErr(&ex.ErrEncrypt{}, err, "Failed to generate token", "TokenCache.IssueOneTime/rand.Read()")
+	}
+	token := base64.RawURLEncoding.EncodeToString(byt)
+	ok, err := tc.Client.SetNX(onceKey(purpose, token), subject, ttl).Result()
+	if err != nil {
+		return "", ex.NewErr(&ex.ErrCacheQuery{}, err, "Failed to issue token", "TokenCache.IssueOneTime/tc.Client.SetNX()")
+	}
+	if !ok {
+		return "", ex.NewErr(&ex.ErrCacheQuery{}, nil, "Failed to issue token", "TokenCache.IssueOneTime/tc.Client.SetNX()")
+	}
+	return token, nil
+}
+
+// ConsumeOneTime : subject of the one time token for the purpose, the token is used up
+// of many consuming the same token at once only one gets the subject
+// ErrTokenExpired : token has expired, was already consumed, was issued for another purpose or never issued
+// ErrCacheQuery : cache could not be queried
+func (tc *TokenCache) ConsumeOneTime(purpose, token string) (string, error) {
+	subject, err := consumeOnce.Run(tc.Client, []string{onceKey(purpose, token)}).Result()
+	if err == redis.Nil {
+		return "", ex.NewErr(&ex.ErrTokenExpired{}, nil, "Link has expired or was already used", "TokenCache.ConsumeOneTime/consumeOnce.Run()")
+	}
+	if err != nil {
+		return "", ex.NewErr(&ex.ErrCacheQuery{}, err, "Failed to consume token", "TokenCache.ConsumeOneTime/consumeOnce.Run()")
+	}
+	result, _ := subject.(string)
+	return result, nil
+}
@@ -0,0 +1,64 @@
+package auth
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	ex "github.com/eensymachines-in/errx"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOneTime(t *testing.T) {
+	cac := testCache(t)
+	defer cac.Close()
+	token, err := cac.IssueOneTime(PurposeReset, "kneeru@gmail.com", time.Minute)
+	assert.Nil(t, err, "Unexpected error issuing token")
+
+	_, err = cac.ConsumeOneTime(PurposeVerify, token)
+	_, ok := err.(*ex.ErrTokenExpired)
+	assert.True(t, ok, "Unexpected error %v consuming for another purpose", err)
+	subject, err := cac.ConsumeOneTime(PurposeReset, token)
+	assert.Nil(t, err, "Token should not be used up by another purpose")
+	assert.Equal(t, "kneeru@gmail.com", subject, "Unexpected subject")
+	_, err = cac.ConsumeOneTime(PurposeReset, token)
+	_, ok = err.(*ex.ErrTokenExpired)
+	assert.True(t, ok, "Unexpected error %v consuming the second time", err)
+
+	// only one of many consuming at once gets the subject
+	token, _ = cac.IssueOneTime(PurposeInvite, "kneeru@gmail.com", time.Minute)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	consumed := 0
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := cac.ConsumeOneTime(PurposeInvite, token); err == nil {
+				mu.Lock()
+				consumed++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, 1, consumed, "Token should be consumed only once")
+
+	// cannot be used as an auth token
+	token, _ = cac.IssueOneTime(PurposeVerify, "kneeru@gmail.com", 100*time.Millisecond)
+	_, err = TokenStr(token).Parse("secretstring")
+	assert.NotNil(t, err, "One time token should not parse as a jwt")
+	_, err = cac.ParseRef(TokenStr(token))
+	assert.NotNil(t, err, "One time token should not parse as a reference")
+
+	<-time.After(150 * time.Millisecond)
+	_, err = cac.ConsumeOneTime(PurposeVerify, token)
+	assert.NotNil(t, err, "Was expecting the token expired")
+
+	for _, ttl := range []time.Duration{0, -time.Second} {
+		_, err = cac.IssueOneTime(PurposeReset, "kneeru@gmail.com", ttl)
+		assert.NotNil(t, err, "Was expecting error for ttl %s", ttl)
+	}
+	_, err = cac.IssueOneTime("", "kneeru@gmail.com", time.Minute)
+	assert.NotNil(t, err, "Was expecting error for empty purpose")
+}
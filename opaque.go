@@ -0,0 +1,182 @@
+package auth
+
+/*
+Opaque tokens : in place of the self-contained jwt the client gets a random reference string
+claims live in the cache under the reference and never leave the server, revoking them is instant
+TokenCache.Opaque turns the mode on, LoginUser/RefreshUser then issue references on the same TokenPair
+references are parsed back with TokenCache.ParseRef, TokenStatus and LogoutToken work just the same
+the reference has to lead to the hash slot of the user, yet not give the user away - the slot hash in it is masked
+with the HMAC of its random part under RefSecret, no two references of the user look alike and none can be matched to an email
+*/
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	ex "github.com/eensymachines-in/errx"
+	"github.com/go-redis/redis/v7"
+)
+
+const (
+	// refPrefix : cache keys for the claims of the reference, keeps them apart from the token UUIDs
+	refPrefix = "ref:"
+	// refLen : random bytes in a reference
+	refLen = 32
+)
+
+var (
+	procSecret     []byte
+	procSecretOnce sync.Once
+)
+
+// refSecret : key the slot hash is masked with, RefSecret or one random to the process when not set
+func (tc *TokenCache) refSecret() []byte {
+	if len(tc.RefSecret) > 0 {
+		return tc.RefSecret
+	}
+	procSecretOnce.Do(func() {
+		procSecret = make([]byte, 32)
+		rand.Read(procSecret)
+	})
+	return procSecret
+}
+
+// refMask : masks the slot hash with the HMAC of the random part of the reference, unmasks it the same way
+func (tc *TokenCache) refMask(nonce, slot []byte) []byte {
+	mac := hmac.New(sha256.New, tc.refSecret())
+	mac.Write(nonce)
+	sum := mac.Sum(nil)
+	result := make([]byte, len(slot))
+	for i := range slot {
+		result[i] = slot[i] ^ sum[i]
+	}
+	return result
+}
+
+// refKey : cache key under which the claims for the reference are, tagged with the slot hash unmasked from it
+// references that are not as issued get a key that is never set
+func (tc *TokenCache) refKey(ref string) string {
+	byt, err := base64.RawURLEncoding.DecodeString(ref)
+	if err != nil || len(byt) != refLen+slotHashLen/2 {
+		return refPrefix + ref
+	}
+	slot := tc.refMask(byt[:refLen], byt[refLen:])
+	return refPrefix + "{" + hex.EncodeToString(slot) + "}" + ref
+}
+
+// newRef : random reference for the user, url safe
+// random bytes and then the slot hash of the user masked, the reference is in the same hash slot as the rest of the keys
+func (tc *TokenCache) newRef(email string) (string, error) {
+	nonce := make([]byte, refLen)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	slot, _ := hex.DecodeString(slotHash(email))
+	return base64.RawURLEncoding.EncodeToString(append(nonce, tc.refMask(nonce, slot)...)), nil
+}
+
+// newRefEntry : cache entry for the claims on the token under a new reference, for ttl - never less than the token lives
+// the token is then marshaled as the reference
+func (tc *TokenCache) newRefEntry(tok *JWTok, ttl time.Duration) (*cacheEntry, error) {
+	ref, err := tc.newRef(tok.User)
+	if err != nil {
+		return nil, ex.NewErr(&ex.ErrEncrypt{}, err, "Failed to get authentication token", "TokenCache.newRefEntry/tc.newRef()")
+	}
+	byt, err := json.Marshal(tok.mapClaims())
+	if err != nil {
+		return nil, ex.NewErr(&ex.ErrInvalid{}, err, "Failed to get authentication token", "TokenCache.newRefEntry/json.Marshal()")
+	}
+	tok.Ref = ref
+	if ttl < tok.Exp {
+		ttl = tok.Exp
+	}
+	return &cacheEntry{key: tc.refKey(ref), val: string(byt), ttl: ttl}, nil
+}
+
+// refVerifier : verifies the references, claims are read from the cache
+type refVerifier struct {
+	tc *TokenCache
+}
+
+// RefVerifier : verifier for the opaque references issued by the cache
+// use this where a Verifier is expected, IntrospectionHandler for instance
+func (tc *TokenCache) RefVerifier() ClaimsVerifier {
+	return &refVerifier{tc: tc}
+}
+
+// VerifyKey : jwts are never verified as references
+func (rv *refVerifier) VerifyKey(tok *jwt.Token) (interface{}, error) {
+	return nil, newTokErr(ErrTokAlgorithm, nil, "refVerifier.VerifyKey")
+}
+
+// VerifyClaims : reads the claims for the reference from the cache
+// references that were logged out, or have expired, or were never issued are all ErrTokExpired
+// ErrCacheQuery : cache could not be queried
+func (rv *refVerifier) VerifyClaims(ts TokenStr) (jwt.MapClaims, error) {
+	ref := string(ts)
+	if ref == "" || strings.Contains(ref, ".") {
+		// jwt or PASETO
+		return nil, newTokErr(ErrTokMalformed, nil, "refVerifier.VerifyClaims")
+	}
+	val, err := rv.tc.Client.Get(rv.tc.refKey(ref)).Result()
+	if err != nil {
+		if err == redis.Nil {
+			return nil, newTokErr(ErrTokExpired, err, "refVerifier.VerifyClaims/tc.Client.Get()")
+		}
+		return nil, ex.NewErr(&ex.ErrCacheQuery{}, err, "Failed to get auth status", "refVerifier.VerifyClaims/tc.Client.Get()")
+	}
+	claims := jwt.MapClaims{}
+	if err := json.Unmarshal([]byte(val), &claims); err != nil {
+		return nil, newTokErr(ErrTokMalformed, err, "refVerifier.VerifyClaims/json.Unmarshal()")
+	}
+	// logout removes the UUID, the reference is no good after that even if the claims are yet to be removed
+	uuid, _ := claims["jti"].(string)
+	user, _ := claims["user"].(string)
+	n, err := rv.tc.Client.Exists(tokKey(user, uuid)).Result()
+	if err != nil {
+		return nil, ex.NewErr(&ex.ErrCacheQuery{}, err, "Failed to get auth status", "refVerifier.VerifyClaims/tc.Client.Exists()")
+	}
+	if n == 0 {
+		return nil, newTokErr(ErrTokExpired, nil, "refVerifier.VerifyClaims/tc.Client.Exists()")
+	}
+	return claims, nil
+}
+
+// refClaims : claims under the reference, even after its token has expired - nil when the reference is gone
+// the claims are kept as long as the refr token of the pair lives, so that Verify can tell which session it was of
+// ErrCacheQuery : cache could not be queried
+func (tc *TokenCache) refClaims(ref string) (jwt.MapClaims, error) {
+	val, err := tc.Client.Get(tc.refKey(ref)).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, ex.NewErr(&ex.ErrCacheQuery{}, err, "Failed to get auth status", "TokenCache.refClaims/tc.Client.Get()")
+	}
+	claims := jwt.MapClaims{}
+	if err := json.Unmarshal([]byte(val), &claims); err != nil {
+		return nil, nil
+	}
+	return claims, nil
+}
+
+// ParseRef : reads the token for the opaque reference from the cache
+// opts : expected issuer, audience and the leeway, as with ParseWith
+// TokErr : ErrTokExpired when the reference was logged out or has expired
+// ErrCacheQuery : cache could not be queried
+func (tc *TokenCache) ParseRef(ts TokenStr, opts ...ParseOption) (*JWTok, error) {
+	tok, err := ts.ParseWith(tc.RefVerifier(), opts...)
+	if err != nil {
+		return nil, err
+	}
+	tok.Ref = string(ts)
+	return tok, nil
+}
@@ -0,0 +1,68 @@
+package auth
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOpaqueTokens(t *testing.T) {
+	cac := testCache(t)
+	defer cac.Close()
+	cac.Opaque = true
+	result := &TokenPair{}
+	assert.Nil(t, cac.LoginUser("kneeru@gmail.com", 2, result, LoginScopes("devices:lock")), "Unexpected error logging in opaque")
+	m := result.MakeMarshalable("secretstring", "secretstring").(map[string]string)
+	assert.Equal(t, result.Auth.Ref, m["auth"], "Was expecting the reference for the auth token")
+	assert.Equal(t, result.Refr.Ref, m["refr"], "Was expecting the reference for the refr token")
+	assert.False(t, strings.Contains(m["auth"], "."), "Reference should not carry claims")
+	assert.NotEqual(t, m["auth"], m["refr"], "Auth and refr references cannot be the same")
+
+	auth, err := cac.ParseRef(TokenStr(m["auth"]))
+	assert.Nil(t, err, "Unexpected error parsing the reference")
+	assert.Equal(t, "kneeru@gmail.com", auth.User, "Unexpected user on the reference")
+	assert.Equal(t, 2, auth.Role, "Unexpected role on the reference")
+	assert.Equal(t, result.Auth.UUID, auth.UUID, "Unexpected uuid on the reference")
+	assert.Equal(t, []string{"devices:lock"}, auth.Scopes, "Unexpected scopes on the reference")
+	assert.Nil(t, cac.TokenStatus(auth), "Unexpected error on the token status")
+
+	// references are not jwts, and jwts are not references
+	_, err = TokenStr(m["auth"]).Parse("secretstring")
+	assert.NotNil(t, err, "Was expecting error parsing the reference as jwt")
+	jwtStr, _ := NewToken("kneeru@gmail.com", 2, AuthExp).ToString("secretstring")
+	_, err = cac.ParseRef(jwtStr)
+	assert.True(t, errors.Is(err, ErrTokMalformed), "Unexpected error %v parsing jwt as reference", err)
+	_, err = cac.ParseRef(TokenStr("neverissued"))
+	assert.True(t, errors.Is(err, ErrTokExpired), "Unexpected error %v parsing reference never issued", err)
+
+	refr, err := cac.ParseRef(TokenStr(m["refr"]))
+	assert.Nil(t, err, "Unexpected error parsing the refr reference")
+	refreshed := &TokenPair{}
+	assert.Nil(t, cac.RefreshUser(refr, refreshed), "Unexpected error refreshing opaque")
+	assert.NotEmpty(t, refreshed.Auth.Ref, "Was expecting refreshed tokens to be opaque")
+	_, err = cac.ParseRef(TokenStr(m["refr"]))
+	assert.True(t, errors.Is(err, ErrTokExpired), "Refr reference should be revoked once used")
+
+	// references of the user cannot be linked to one another nor to the email
+	for _, ref := range []string{m["auth"], m["refr"], refreshed.Auth.Ref} {
+		assert.False(t, strings.Contains(ref, slotHash("kneeru@gmail.com")), "Reference should not carry the slot hash as is")
+	}
+	assert.NotEqual(t, m["auth"][:8], refreshed.Auth.Ref[:8], "References of the user should share no prefix")
+	assert.NotEqual(t, m["auth"][len(m["auth"])-8:], refreshed.Auth.Ref[len(refreshed.Auth.Ref)-8:], "References of the user should share no suffix")
+	// another secret unmasks another slot, the reference is not found
+	other := &TokenCache{Client: cac.Client, Opaque: true, RefSecret: []byte("othersecret")}
+	_, err = other.ParseRef(TokenStr(refreshed.Auth.Ref))
+	assert.True(t, errors.Is(err, ErrTokExpired), "Unexpected error %v parsing reference under another secret", err)
+
+	// revocation is instant
+	assert.Nil(t, cac.LogoutToken(auth), "Unexpected error logging out the reference")
+	_, err = cac.ParseRef(TokenStr(m["auth"]))
+	assert.True(t, errors.Is(err, ErrTokExpired), "Unexpected error %v parsing logged out reference", err)
+	// logout by the uuid, without the reference, still revokes the reference
+	cac.LogoutToken(&JWTok{User: refreshed.Auth.User, UUID: refreshed.Auth.UUID})
+	_, err = cac.ParseRef(TokenStr(refreshed.Auth.Ref))
+	assert.True(t, errors.Is(err, ErrTokExpired), "Unexpected error %v parsing reference after uuid logout", err)
+	cac.LogoutToken(refreshed.Refr)
+}
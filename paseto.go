@@ -0,0 +1,265 @@
+package auth
+
+/*
+PASETO v4 tokens as an alternative to jwt - there is no alg header to confuse, the version and purpose decide it all
+v4.public : signed with Ed25519, services verify with the public key
+v4.local : encrypted and authenticated with a 32 byte shared key (XChaCha20 + BLAKE2b-MAC)
+Both are Signers and Verifiers, hence SignWith/ParseWith work just the same as with jwt
+Claims are the same as on jwt, except exp, nbf, iat go as RFC 3339 strings as the PASETO spec wants
+https://github.com/paseto-standard/paseto-spec/blob/master/docs/01-Protocol-Versions/Version4.md
+*/
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	ex "github.com/eensymachines-in/errx"
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/chacha20"
+)
+
+const (
+	pasetoPublicHeader = "v4.public."
+	pasetoLocalHeader  = "v4.local."
+)
+
+// pasetoTimeClaims : claims that PASETO wants as RFC 3339 strings and not as numeric dates
+var pasetoTimeClaims = []string{"exp", "nbf", "iat"}
+
+// pae : pre-authentication encoding, every piece is prefixed with its length so that the pieces cannot be shifted around
+func pae(pieces ...[]byte) []byte {
+	le64 := func(n int) []byte {
+		b := make([]byte, 8)
+		binary.LittleEndian.PutUint64(b, uint64(n)&^(1<<63))
+		return b
+	}
+	buf := &bytes.Buffer{}
+	buf.Write(le64(len(pieces)))
+	for _, p := range pieces {
+		buf.Write(le64(len(p)))
+		buf.Write(p)
+	}
+	return buf.Bytes()
+}
+
+// pasetoPayload : jwt claims to the PASETO json payload
+func pasetoPayload(claims jwt.Claims) ([]byte, error) {
+	mc, ok := claims.(jwt.MapClaims)
+	if !ok {
+		return nil, ex.NewErr(&ex.ErrInvalid{}, nil, "Failed to get authentication token", "pasetoPayload")
+	}
+	payload := map[string]interface{}{}
+	for k, v := range mc {
+		payload[k] = v
+	}
+	for _, k := range pasetoTimeClaims {
+		var unix int64
+		switch t := payload[k].(type) {
+		case int64:
+			unix = t
+		case float64:
+			unix = int64(t)
+		default:
+			continue
+		}
+		payload[k] = time.Unix(unix, 0).UTC().Format(time.RFC3339)
+	}
+	return json.Marshal(payload)
+}
+
+// pasetoClaims : PASETO json payload to jwt claims, RFC 3339 times are read back as numeric dates
+func pasetoClaims(payload []byte) (jwt.MapClaims, error) {
+	claims := jwt.MapClaims{}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, newTokErr(ErrTokMalformed, err, "pasetoClaims/json.Unmarshal")
+	}
+	for _, k := range pasetoTimeClaims {
+		if str, ok := claims[k].(string); ok {
+			if t, err := time.Parse(time.RFC3339, str); err == nil {
+				claims[k] = float64(t.Unix())
+			} // else left as it is, and decoding the claims would flag it
+		}
+	}
+	return claims, nil
+}
+
+// pasetoBody : splits the token into the decoded body and the footer, after checking the header
+func pasetoBody(ts TokenStr, header string) ([]byte, []byte, error) {
+	str := string(ts)
+	if !strings.HasPrefix(str, header) {
+		if strings.Count(str, ".") >= 2 {
+			// jwt or PASETO of another version / purpose
+			return nil, nil, newTokErr(ErrTokAlgorithm, nil, "pasetoBody")
+		}
+		return nil, nil, newTokErr(ErrTokMalformed, nil, "pasetoBody")
+	}
+	parts := strings.Split(str[len(header):], ".")
+	if len(parts) > 2 {
+		return nil, nil, newTokErr(ErrTokMalformed, nil, "pasetoBody")
+	}
+	body, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, nil, newTokErr(ErrTokMalformed, err, "pasetoBody")
+	}
+	footer := []byte{}
+	if len(parts) == 2 {
+		if footer, err = base64.RawURLEncoding.DecodeString(parts[1]); err != nil {
+			return nil, nil, newTokErr(ErrTokMalformed, err, "pasetoBody")
+		}
+	}
+	return body, footer, nil
+}
+
+// ++++++++++++++++++++++++++++++++ v4.public ++++++++++++++++++++++++++++++++++++++++++++
+
+// PasetoPublic : PASETO v4.public tokens, signed with the Ed25519 private key and verified with the public key
+type PasetoPublic struct {
+	Priv ed25519.PrivateKey // nil on services that only verify
+	Pub  ed25519.PublicKey
+}
+
+// NewPasetoPublic : signs and verifies v4.public tokens, to be used on the AuthAPI
+func NewPasetoPublic(priv ed25519.PrivateKey) *PasetoPublic {
+	return &PasetoPublic{Priv: priv, Pub: priv.Public().(ed25519.PublicKey)}
+}
+
+// NewPasetoPublicVerifier : only verifies v4.public tokens, to be used on the other services
+func NewPasetoPublicVerifier(pub ed25519.PublicKey) *PasetoPublic {
+	return &PasetoPublic{Pub: pub}
+}
+
+// Sign : signs the claims on the token as v4.public
+func (pp *PasetoPublic) Sign(tok *jwt.Token) (string, error) {
+	if len(pp.Priv) != ed25519.PrivateKeySize {
+		return "", ex.NewErr(&ex.ErrInvalid{}, nil, "Cannot sign without the private key", "PasetoPublic.Sign")
+	}
+	m, err := pasetoPayload(tok.Claims)
+	if err != nil {
+		return "", err
+	}
+	sig := ed25519.Sign(pp.Priv, pae([]byte(pasetoPublicHeader), m, []byte{}, []byte{}))
+	return pasetoPublicHeader + base64.RawURLEncoding.EncodeToString(append(m, sig...)), nil
+}
+
+// VerifyKey : jwts are never verified as PASETO
+func (pp *PasetoPublic) VerifyKey(tok *jwt.Token) (interface{}, error) {
+	return nil, newTokErr(ErrTokAlgorithm, nil, "PasetoPublic.VerifyKey")
+}
+
+// VerifyClaims : verifies the v4.public signature and hands out the claims
+func (pp *PasetoPublic) VerifyClaims(ts TokenStr) (jwt.MapClaims, error) {
+	body, footer, err := pasetoBody(ts, pasetoPublicHeader)
+	if err != nil {
+		return nil, err
+	}
+	if len(body) < ed25519.SignatureSize {
+		return nil, newTokErr(ErrTokMalformed, nil, "PasetoPublic.VerifyClaims")
+	}
+	m, sig := body[:len(body)-ed25519.SignatureSize], body[len(body)-ed25519.SignatureSize:]
+	if len(pp.Pub) != ed25519.PublicKeySize || !ed25519.Verify(pp.Pub, pae([]byte(pasetoPublicHeader), m, footer, []byte{}), sig) {
+		return nil, newTokErr(ErrTokSignature, nil, "PasetoPublic.VerifyClaims")
+	}
+	return pasetoClaims(m)
+}
+
+// ++++++++++++++++++++++++++++++++ v4.local ++++++++++++++++++++++++++++++++++++++++++++
+
+// PasetoLocal : PASETO v4.local tokens, encrypted with a 32 byte shared key
+// claims on the token are not readable by anyone without the key
+type PasetoLocal struct {
+	Key []byte
+}
+
+// NewPasetoLocal : key has to be 32 bytes
+// ErrInvalid : key is not 32 bytes
+func NewPasetoLocal(key []byte) (*PasetoLocal, error) {
+	if len(key) != 32 {
+		return nil, ex.NewErr(&ex.ErrInvalid{}, nil, "Key for local tokens has to be 32 bytes", "NewPasetoLocal")
+	}
+	return &PasetoLocal{Key: key}, nil
+}
+
+// keys : splits the key to encryption key, nonce and the authentication key for the nonce
+func (pl *PasetoLocal) keys(n []byte) (ek, n2, ak []byte) {
+	h, _ := blake2b.New(56, pl.Key)
+	h.Write([]byte("paseto-encryption-key"))
+	h.Write(n)
+	tmp := h.Sum(nil)
+	h, _ = blake2b.New(32, pl.Key)
+	h.Write([]byte("paseto-auth-key-for-aead"))
+	h.Write(n)
+	return tmp[:32], tmp[32:], h.Sum(nil)
+}
+
+// mac : BLAKE2b-MAC over the pre-authentication encoding
+func (pl *PasetoLocal) mac(ak, n, c, footer []byte) []byte {
+	h, _ := blake2b.New(32, ak)
+	h.Write(pae([]byte(pasetoLocalHeader), n, c, footer, []byte{}))
+	return h.Sum(nil)
+}
+
+// encrypt : encrypts the payload with the nonce n
+func (pl *PasetoLocal) encrypt(m, n []byte) (string, error) {
+	ek, n2, ak := pl.keys(n)
+	cipher, err := chacha20.NewUnauthenticatedCipher(ek, n2)
+	if err != nil {
+		return "", ex.NewErr(&ex.ErrEncrypt{}, err, "Failed to get authentication token", "PasetoLocal.encrypt")
+	}
+	c := make([]byte, len(m))
+	cipher.XORKeyStream(c, m)
+	t := pl.mac(ak, n, c, []byte{})
+	body := append(append(append([]byte{}, n...), c...), t...)
+	return pasetoLocalHeader + base64.RawURLEncoding.EncodeToString(body), nil
+}
+
+// Sign : encrypts the claims on the token as v4.local
+func (pl *PasetoLocal) Sign(tok *jwt.Token) (string, error) {
+	if len(pl.Key) != 32 {
+		return "", ex.NewErr(&ex.ErrInvalid{}, nil, "Key for local tokens has to be 32 bytes", "PasetoLocal.Sign")
+	}
+	m, err := pasetoPayload(tok.Claims)
+	if err != nil {
+		return "", err
+	}
+	n := make([]byte, 32)
+	if _, err := rand.Read(n); err != nil {
+		return "", ex.NewErr(&ex.ErrEncrypt{}, err, "Failed to get authentication token", "PasetoLocal.Sign/rand.Read")
+	}
+	return pl.encrypt(m, n)
+}
+
+// VerifyKey : jwts are never verified as PASETO
+func (pl *PasetoLocal) VerifyKey(tok *jwt.Token) (interface{}, error) {
+	return nil, newTokErr(ErrTokAlgorithm, nil, "PasetoLocal.VerifyKey")
+}
+
+// VerifyClaims : authenticates and decrypts the v4.local token and hands out the claims
+func (pl *PasetoLocal) VerifyClaims(ts TokenStr) (jwt.MapClaims, error) {
+	body, footer, err := pasetoBody(ts, pasetoLocalHeader)
+	if err != nil {
+		return nil, err
+	}
+	if len(body) < 64 || len(pl.Key) != 32 {
+		return nil, newTokErr(ErrTokMalformed, nil, "PasetoLocal.VerifyClaims")
+	}
+	n, c, t := body[:32], body[32:len(body)-32], body[len(body)-32:]
+	ek, n2, ak := pl.keys(n)
+	if subtle.ConstantTimeCompare(t, pl.mac(ak, n, c, footer)) != 1 {
+		return nil, newTokErr(ErrTokSignature, nil, "PasetoLocal.VerifyClaims")
+	}
+	cipher, err := chacha20.NewUnauthenticatedCipher(ek, n2)
+	if err != nil {
+		return nil, newTokErr(ErrTokMalformed, err, "PasetoLocal.VerifyClaims")
+	}
+	m := make([]byte, len(c))
+	cipher.XORKeyStream(m, c)
+	return pasetoClaims(m)
+}
@@ -0,0 +1,99 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPasetoVector(t *testing.T) {
+	// 4-S-1 from the PASETO test vectors
+	sk, _ := hex.DecodeString("b4cbfb43df4ce210727d953e4a713307fa19bb7d9f85041438d9e11b942a37741eb9dbbbbc047c03fd70604e0071f0987e16b28b757225c11f00415d0e20b1a2")
+	m := []byte(`{"data":"this is a signed message","exp":"2022-01-01T00:00:00+00:00"}`)
+	sig := ed25519.Sign(ed25519.PrivateKey(sk), pae([]byte(pasetoPublicHeader), m, []byte{}, []byte{}))
+	expected := "v4.public.eyJkYXRhIjoidGhpcyBpcyBhIHNpZ25lZCBtZXNzYWdlIiwiZXhwIjoiMjAyMi0wMS0wMVQwMDowMDowMCswMDowMCJ9bg_XBBzds8lTZShVlwwKSgeKpLT3yukTw6JUz3W4h_ExsQV-P0V54zemZDcAxFaSeef1QlXEFtkqxT1ciiQEDA"
+	assert.Equal(t, expected, pasetoPublicHeader+base64.RawURLEncoding.EncodeToString(append(m, sig...)), "Unexpected v4.public token")
+	claims, err := NewPasetoPublic(ed25519.PrivateKey(sk)).VerifyClaims(TokenStr(expected))
+	assert.Nil(t, err, "Unexpected error verifying v4.public test vector")
+	assert.Equal(t, float64(1640995200), claims["exp"], "Unexpected exp read from the test vector")
+}
+
+func TestPasetoLocalVector(t *testing.T) {
+	// 4-E-1 and 4-E-2 from the PASETO test vectors
+	key, _ := hex.DecodeString("707172737475767778797a7b7c7d7e7f808182838485868788898a8b8c8d8e8f")
+	local, _ := NewPasetoLocal(key)
+	data := []struct {
+		name     string
+		m        string
+		expected string
+	}{
+		{"4-E-1", `{"data":"this is a secret message","exp":"2022-01-01T00:00:00+00:00"}`, "v4.local.AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAQAr68PS4AXe7If_ZgesdkUMvSwscFlAl1pk5HC0e8kApeaqMfGo_7OpBnwJOAbY9V7WU6abu74MmcUE8YWAiaArVI8XJ5hOb_4v9RmDkneN0S92dx0OW4pgy7omxgf3S8c3LlQg"},
+		{"4-E-2", `{"data":"this is a hidden message","exp":"2022-01-01T00:00:00+00:00"}`, "v4.local.AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAQAr68PS4AXe7If_ZgesdkUMvS2csCgglvpk5HC0e8kApeaqMfGo_7OpBnwJOAbY9V7WU6abu74MmcUE8YWAiaArVI8XIemu9chy3WVKvRBfg6t8wwYHK0ArLxxfZP73W_vfwt5A"},
+	}
+	for _, d := range data {
+		tokStr, err := local.encrypt([]byte(d.m), make([]byte, 32))
+		assert.Nil(t, err, "Unexpected error encrypting %s", d.name)
+		assert.Equal(t, d.expected, tokStr, "Unexpected v4.local token for %s", d.name)
+		claims, err := local.VerifyClaims(TokenStr(d.expected))
+		if assert.Nil(t, err, "Unexpected error decrypting %s", d.name) {
+			assert.Equal(t, float64(1640995200), claims["exp"], "Unexpected exp read from %s", d.name)
+		}
+	}
+}
+
+func TestPaseto(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+	key := make([]byte, 32)
+	rand.Read(key)
+	local, err := NewPasetoLocal(key)
+	assert.Nil(t, err, "Unexpected error making local PASETO")
+	_, err = NewPasetoLocal(key[:16])
+	assert.NotNil(t, err, "Was expecting error for short key")
+
+	data := []struct {
+		purpose string
+		s       Signer
+		v       Verifier
+	}{
+		{"v4.public", NewPasetoPublic(priv), NewPasetoPublicVerifier(pub)},
+		{"v4.local", local, local},
+	}
+	for _, d := range data {
+		authTok := NewToken("kneeru@gmail.com", 2, AuthExp, WithIssuer("autolumin"), WithScopes("devices:read"))
+		tokStr, err := authTok.SignWith(d.s)
+		assert.Nil(t, err, "Unexpected error signing %s", d.purpose)
+		t.Log(tokStr)
+		tok, err := tokStr.ParseWith(d.v, ExpectIssuer("autolumin"))
+		assert.Nil(t, err, "Unexpected error parsing %s", d.purpose)
+		assert.Equal(t, authTok.UUID, tok.UUID, "Unexpected uuid on %s", d.purpose)
+		assert.Equal(t, authTok.IssuedAt.Unix(), tok.IssuedAt.Unix(), "Unexpected iat on %s", d.purpose)
+		assert.True(t, tok.HasScope("devices:read"), "Unexpected scopes on %s", d.purpose)
+		// tampered tokens
+		tampered := []byte(tokStr)
+		// swaps a char mid signature/tag, the last char could be just the padding bits
+		if tampered[len(tampered)-10] == 'A' {
+			tampered[len(tampered)-10] = 'B'
+		} else {
+			tampered[len(tampered)-10] = 'A'
+		}
+		_, err = TokenStr(tampered).ParseWith(d.v)
+		assert.True(t, errors.Is(err, ErrTokSignature), "Unexpected error %v for tampered %s", err, d.purpose)
+		// jwts are not PASETO
+		jwtStr, _ := authTok.ToString("secretstring")
+		_, err = jwtStr.ParseWith(d.v)
+		assert.True(t, errors.Is(err, ErrTokAlgorithm), "Unexpected error %v for jwt parsed as %s", err, d.purpose)
+	}
+	// local token cannot be verified as public and vice versa
+	tokStr, _ := NewToken("kneeru@gmail.com", 2, AuthExp).SignWith(local)
+	_, err = tokStr.ParseWith(NewPasetoPublicVerifier(pub))
+	assert.True(t, errors.Is(err, ErrTokAlgorithm), "Unexpected error %v for local token verified as public", err)
+	// expired PASETO tokens
+	tokStr, _ = NewToken("kneeru@gmail.com", 2, -1*AuthExp).SignWith(NewPasetoPublic(priv))
+	_, err = tokStr.ParseWith(NewPasetoPublicVerifier(pub))
+	assert.True(t, errors.Is(err, ErrTokExpired), "Unexpected error %v for expired token", err)
+}
@@ -0,0 +1,133 @@
+package auth
+
+/*
+TokenPolicy decides how long the tokens of a login live, in place of one lifetime for all
+admins could do with shorter lives than users, devices that cannot login again easily with longer
+lifetime is picked from the explicit LoginLifetime option, then the type of client, then the role, then the default
+durations left zero are taken from the next in line, AuthExp and RefrExp being the last
+Sessions can also have an idle timeout, extended every time a token of the session is checked or refreshed
+and an absolute cap recorded at login, active sessions live on but none lives beyond the cap
+Policy also limits how many sessions a user can have at once, by the role - for the customers licensed per seat
+a login over the limit is either rejected, or the oldest session is revoked to make way for it
+*/
+
+import (
+	"time"
+)
+
+// Lifetime : how long the tokens of a login live
+type Lifetime struct {
+	Auth time.Duration
+	Refr time.Duration
+	Idle time.Duration // session ends when none of its tokens is used this long, 0 for no idle timeout
+	Max  time.Duration // session ends this long after the login no matter the activity, 0 for no cap
+}
+
+// fill : durations left zero are taken from the other
+func (lt Lifetime) fill(other Lifetime) Lifetime {
+	if lt.Auth <= 0 {
+		lt.Auth = other.Auth
+	}
+	if lt.Refr <= 0 {
+		lt.Refr = other.Refr
+	}
+	if lt.Idle <= 0 {
+		lt.Idle = other.Idle
+	}
+	if lt.Max <= 0 {
+		lt.Max = other.Max
+	}
+	return lt
+}
+
+// capped : tokens live no longer than the duration
+func (lt Lifetime) capped(d time.Duration) Lifetime {
+	if lt.Auth > d {
+		lt.Auth = d
+	}
+	if lt.Refr > d {
+		lt.Refr = d
+	}
+	return lt
+}
+
+// LimitPolicy : what becomes of a login when the user already has as many sessions as the limit
+type LimitPolicy int
+
+const (
+	// RejectNew : login is rejected, the user has to logout elsewhere first
+	RejectNew LimitPolicy = iota
+	// EvictOldest : oldest sessions are revoked to make way for the login
+	EvictOldest
+)
+
+// SessionLimit : how many sessions the user can have at once
+type SessionLimit struct {
+	Max    int // live sessions at once, 0 for no limit
+	Policy LimitPolicy
+}
+
+// TokenPolicy : lifetimes of the tokens by the role of the user and the type of client
+// set it up before the store is in use, it is not to be changed after
+type TokenPolicy struct {
+	Default Lifetime             // when neither the client nor the role has one
+	Roles   map[int]Lifetime     // by the role of the user
+	Clients map[string]Lifetime  // by the type of client - web, mobile, device
+	Limit   SessionLimit         // sessions at once, when the role has no limit of its own
+	Limits  map[int]SessionLimit // by the role of the user, zero Max exempts the role from Limit
+	// Grace : refr token presented again this soon after it was used is a retry and not a theft, emits EvtRefrRetry
+	// zero has none, the refr token is then good for exactly one use - a replay within the grace goes unnoticed, keep it short
+	Grace time.Duration
+}
+
+// lifetime : lifetime of the tokens for the login, nil policy has the defaults
+// refr token never lives shorter than the auth token, and neither beyond the cap on the session
+func (tp *TokenPolicy) lifetime(role int, client string, explicit Lifetime) Lifetime {
+	result := explicit
+	if tp != nil {
+		result = result.fill(tp.Clients[client]).fill(tp.Roles[role]).fill(tp.Default)
+	}
+	result = result.fill(Lifetime{Auth: AuthExp, Refr: RefrExp})
+	if result.Refr < result.Auth {
+		result.Refr = result.Auth
+	}
+	if result.Max > 0 {
+		result = result.capped(result.Max)
+	}
+	return result
+}
+
+// limit : limit on the sessions of the user for the role, nil policy has no limit
+func (tp *TokenPolicy) limit(role int) SessionLimit {
+	if tp == nil {
+		return SessionLimit{}
+	}
+	if sl, ok := tp.Limits[role]; ok {
+		return sl
+	}
+	return tp.Limit
+}
+
+// grace : time after a refr token was used in which it can be used again, none for a nil policy
+func (tp *TokenPolicy) grace() time.Duration {
+	if tp == nil || tp.Grace < 0 {
+		return 0
+	}
+	return tp.Grace
+}
+
+// LoginClient : type of client the login is from, lifetimes of the tokens are by the TokenPolicy for the client
+// the tokens carry it as client_type so the refreshes after have the same lifetimes
+func LoginClient(client string) LoginOption {
+	return func(lc *loginConf) {
+		lc.client = client
+	}
+}
+
+// LoginLifetime : lifetimes of the tokens for this login, overrides the TokenPolicy
+// durations left zero are by the policy, refreshes after the login are by the policy too
+func LoginLifetime(auth, refr time.Duration) LoginOption {
+	return func(lc *loginConf) {
+		lc.lifetime = Lifetime{Auth: auth, Refr: refr}
+	}
+}
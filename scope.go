@@ -0,0 +1,61 @@
+package auth
+
+/*
+Scopes are finer than the role elevation, a user may lock devices but not delete users for instance
+Scopes go on the token as the space separated "scope" claim (RFC 8693)
+*/
+
+import (
+	"strings"
+)
+
+// WithScopes : stamps the scope claim on the token
+func WithScopes(scopes ...string) TokOption {
+	return func(jt *JWTok) {
+		jt.Scopes = scopes
+	}
+}
+
+// HasScope : checks to see if the token was granted the scope
+func (jt *JWTok) HasScope(scope string) bool {
+	for _, s := range jt.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// HasAllScopes : checks to see if the token was granted each of the scopes
+func (jt *JWTok) HasAllScopes(scopes ...string) bool {
+	for _, s := range scopes {
+		if !jt.HasScope(s) {
+			return false
+		}
+	}
+	return true
+}
+
+// HasAnyScope : checks to see if the token was granted atleast one of the scopes
+func (jt *JWTok) HasAnyScope(scopes ...string) bool {
+	for _, s := range scopes {
+		if jt.HasScope(s) {
+			return true
+		}
+	}
+	return false
+}
+
+// joinScopes : scopes as they go on the claim
+func joinScopes(scopes []string) string {
+	return strings.Join(scopes, " ")
+}
+
+// splitScopes : scopes as read from the claim
+func splitScopes(scope string) []string {
+	result := strings.Fields(scope)
+	if len(result) == 0 {
+		return nil
+	}
+	return result
+}
@@ -0,0 +1,21 @@
+package auth
+
+import (
+	"testing"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScopes(t *testing.T) {
+	tokStr, _ := NewToken("kneeru@gmail.com", 2, AuthExp, WithScopes("devices:lock", "devices:read")).ToString("secretstring")
+	tok, err := tokStr.Parse("secretstring")
+	assert.Nil(t, err, "Unexpected error parsing token with scopes")
+	assert.Equal(t, "devices:lock devices:read", tok.Claims.(jwt.MapClaims)["scope"], "Unexpected scope claim on the token")
+	assert.True(t, tok.HasScope("devices:lock"), "Was expecting token to have scope")
+	assert.False(t, tok.HasScope("users:delete"), "Was not expecting token to have scope")
+	assert.True(t, tok.HasAllScopes("devices:lock", "devices:read"), "Was expecting token to have all scopes")
+	assert.False(t, tok.HasAllScopes("devices:lock", "users:delete"), "Was not expecting token to have all scopes")
+	assert.True(t, tok.HasAnyScope("users:delete", "devices:read"), "Was expecting token to have any of the scopes")
+	assert.False(t, tok.HasAnyScope("users:delete", "users:read"), "Was not expecting token to have any of the scopes")
+}
@@ -0,0 +1,241 @@
+package auth
+
+/*
+Every login is a session, all the tokens rotated from the login belong to it (sid claim)
+sessions of a user are indexed by the email, so that the user can be logged out everywhere
+- when the password changes, or the account is removed
+Index is a sorted set by the time of login, sessions that have expired are pruned when listed
+Every session has a hash of metadata - where the login is from and when it was last seen
+so the user can be shown where all they are logged in, last seen is updated on TokenStatus and refresh
+Session is alive as long as its metadata is - idle timeout and the cap on the session are the ttl on it
+*/
+
+import (
+	"strconv"
+	"time"
+
+	ex "github.com/eensymachines-in/errx"
+	"github.com/go-redis/redis/v7"
+)
+
+const (
+	// userPrefix : cache keys for the index of sessions of the user
+	userPrefix = "user:"
+	// metaPrefix : cache keys for the metadata of the session
+	metaPrefix = "meta:"
+)
+
+// userKey : cache key for the index of sessions of the user
+func userKey(email string) string {
+	return userPrefix + slotTag(email) + email
+}
+
+// metaKey : cache key for the hash of metadata of the session of the user
+func metaKey(email, sid string) string {
+	return metaPrefix + slotTag(email) + sid
+}
+
+// SessionMeta : where the login is from, set once at login and kept for all the refreshes after
+type SessionMeta struct {
+	IP        string `json:"ip"`
+	UserAgent string `json:"user_agent"`
+	Serial    string `json:"serial,omitempty"` // device serial, when the login is from a device
+	Method    string `json:"method"`           // how the user logged in - password, device ..
+}
+
+// fields : field value pairs for the hash of the metadata in the cache
+func (sm *SessionMeta) fields() []interface{} {
+	return []interface{}{"ip", sm.IP, "ua", sm.UserAgent, "serial", sm.Serial, "method", sm.Method}
+}
+
+// LoginMeta : metadata of the session the login starts
+func LoginMeta(meta SessionMeta) LoginOption {
+	return func(lc *loginConf) {
+		lc.meta = &meta
+	}
+}
+
+// Session : login of the user, all the tokens rotated from the login belong to it
+type Session struct {
+	ID       string        `json:"id"` // sid on the tokens
+	User     string        `json:"user"`
+	Created  time.Time     `json:"created"`        // time of login
+	LastSeen time.Time     `json:"last_seen"`      // last time a token of the session was checked or refreshed
+	Idle     time.Duration `json:"idle,omitempty"` // session ends when unused this long, 0 when there is no idle timeout
+	Expires  time.Time     `json:"expires"`        // session ends at this time no matter the activity, zero when there is no cap
+	SessionMeta
+}
+
+// unixMilli : time from unix milliseconds as stored in the cache
+func unixMilli(val string) time.Time {
+	ms, _ := strconv.ParseInt(val, 10, 64)
+	return time.Unix(0, ms*int64(time.Millisecond))
+}
+
+// setMeta : reads in the metadata from the hash in the cache
+func (s *Session) setMeta(hash map[string]string) {
+	s.IP, s.UserAgent, s.Serial, s.Method = hash["ip"], hash["ua"], hash["serial"], hash["method"]
+	if seen, ok := hash["seen"]; ok {
+		s.LastSeen = unixMilli(seen)
+	}
+	if idle, ok := hash["idle"]; ok {
+		ms, _ := strconv.ParseInt(idle, 10, 64)
+		s.Idle = time.Duration(ms) * time.Millisecond
+	}
+	if until, ok := hash["until"]; ok {
+		s.Expires = unixMilli(until)
+	}
+}
+
+// SessionRegistry : sessions of the user, listed and revoked by the email
+type SessionRegistry interface {
+	ListSessions(email string) ([]*Session, error)
+	GetSession(email, id string) (*Session, error)
+	RevokeSession(email, id string) error
+	RevokeAllSessions(email string) error
+}
+
+var (
+	_ SessionRegistry = &TokenCache{}
+	_ SessionRegistry = &MemStore{}
+)
+
+// listSessions : sessions in the index that are yet to expire, with the time of login and the metadata
+// KEYS[1] is the index, ARGV[1] the prefix of session keys, ARGV[2] the prefix of metadata keys
+// sessions that have expired, or idled out, are removed from the index
+// session and metadata keys are made from the prefixes and not in KEYS, they have the slot tag of the user as KEYS[1] does
+var listSessions = redis.NewScript(`
+local result = {}
+local entries = redis.call("ZRANGE", KEYS[1], 0, -1, "WITHSCORES")
+for i = 1, #entries, 2 do
+	if redis.call("EXISTS", ARGV[1] .. entries[i]) == 1 and redis.call("EXISTS", ARGV[2] .. entries[i]) == 1 then
+		table.insert(result, entries[i])
+		table.insert(result, entries[i+1])
+		table.insert(result, redis.call("HGETALL", ARGV[2] .. entries[i]))
+	else
+		redis.call("ZREM", KEYS[1], entries[i])
+	end
+end
+return result
+`)
+
+// revokeSessions : removes all the keys in the sessions, the sessions and their entries in the index
+// KEYS[1] is the index, ARGV[1] the prefix of session keys, then the sids - when none all the sessions in the index
+// metadata of the session is in the session set and goes with it
+// the tokens in the sessions are put on the denylist, as revokeLua does
+// sids not in the index are left alone, returns the count of sessions revoked and the jti, ttl pairs denied
+// session keys made from the prefix and the keys read from the session sets are not in KEYS
+// all of them have the slot tag of the user as KEYS[1] does, the script stays in the one slot on a cluster
+var revokeSessions = redis.NewScript(revokeLua + `
+local sids = {}
+local denied = {}
+if #ARGV > 1 then
+	for i = 2, #ARGV do
+		if redis.call("ZSCORE", KEYS[1], ARGV[i]) then
+			table.insert(sids, ARGV[i])
+		end
+	end
+else
+	sids = redis.call("ZRANGE", KEYS[1], 0, -1)
+end
+for _, sid in ipairs(sids) do
+	for _, x in ipairs(revoke(ARGV[1] .. sid)) do
+		table.insert(denied, x)
+	end
+	redis.call("ZREM", KEYS[1], sid)
+end
+return {#sids, denied}
+`)
+
+// endSession : ends the session when none of its tokens is left, after a logout
+// KEYS[1] is the session set, KEYS[2] the index, KEYS[3] the metadata of the session - ARGV[1] the sid, ARGV[2] the prefix of reference keys
+// claims under the references outlive the tokens and do not count, they go with the session
+// returns 1 when the session has ended, 0 when a token of it is still in the cache
+// keys read from the session set are not in KEYS, they have the slot tag of the user as the KEYS do
+var endSession = redis.NewScript(`
+local members = redis.call("SMEMBERS", KEYS[1])
+for _, k in ipairs(members) do
+	if k ~= KEYS[3] and string.sub(k, 1, #ARGV[2]) ~= ARGV[2] and redis.call("EXISTS", k) == 1 then
+		return 0
+	end
+end
+for _, k in ipairs(members) do
+	redis.call("DEL", k)
+end
+redis.call("DEL", KEYS[1], KEYS[3])
+redis.call("ZREM", KEYS[2], ARGV[1])
+return 1
+`)
+
+// ListSessions : sessions of the user that are yet to expire, oldest first
+// ErrCacheQuery : cache could not be queried
+func (tc *TokenCache) ListSessions(email string) ([]*Session, error) {
+	val, err := listSessions.Run(tc.Client, []string{userKey(email)}, sessPrefix+slotTag(email), metaPrefix+slotTag(email)).Result()
+	if err != nil {
+		return nil, ex.NewErr(&ex.ErrCacheQuery{}, err, "Failed to get sessions", "TokenCache.ListSessions/listSessions.Run()")
+	}
+	entries, _ := val.([]interface{})
+	result := []*Session{}
+	for i := 0; i+2 < len(entries); i += 3 {
+		sid, _ := entries[i].(string)
+		score, _ := entries[i+1].(string)
+		sess := &Session{ID: sid, User: email, Created: unixMilli(score)}
+		pairs, _ := entries[i+2].([]interface{})
+		hash := map[string]string{}
+		for j := 0; j+1 < len(pairs); j += 2 {
+			k, _ := pairs[j].(string)
+			v, _ := pairs[j+1].(string)
+			hash[k] = v
+		}
+		sess.setMeta(hash)
+		result = append(result, sess)
+	}
+	return result, nil
+}
+
+// GetSession : session of the user with the metadata
+// ErrNotFound : user has no such session, or it has expired or idled out
+// ErrCacheQuery : cache could not be queried
+func (tc *TokenCache) GetSession(email, id string) (*Session, error) {
+	pipe := tc.Client.TxPipeline()
+	score := pipe.ZScore(userKey(email), id)
+	exists := pipe.Exists(sessKey(email, id))
+	meta := pipe.HGetAll(metaKey(email, id))
+	if _, err := pipe.Exec(); err != nil && err != redis.Nil {
+		return nil, ex.NewErr(&ex.ErrCacheQuery{}, err, "Failed to get session", "TokenCache.GetSession/pipe.Exec()")
+	}
+	if score.Err() == redis.Nil || exists.Val() == 0 || len(meta.Val()) == 0 {
+		return nil, ex.NewErr(&ex.ErrNotFound{}, nil, "No such session for the user", "TokenCache.GetSession/pipe.Exec()")
+	}
+	sess := &Session{ID: id, User: email, Created: time.Unix(0, int64(score.Val())*int64(time.Millisecond))}
+	sess.setMeta(meta.Val())
+	return sess, nil
+}
+
+// RevokeSession : logs out all the tokens in the session of the user
+// the tokens are put on the denylist and published, as LogoutToken does
+// ErrNotFound : user has no such session
+// ErrCacheQuery : cache could not be queried
+func (tc *TokenCache) RevokeSession(email, id string) error {
+	val, err := revokeSessions.Run(tc.Client, []string{userKey(email)}, sessPrefix+slotTag(email), id).Result()
+	if err != nil {
+		return ex.NewErr(&ex.ErrCacheQuery{}, err, "Failed to revoke session", "TokenCache.RevokeSession/revokeSessions.Run()")
+	}
+	res, _ := val.([]interface{})
+	if len(res) == 0 || res[0] == int64(0) {
+		return ex.NewErr(&ex.ErrNotFound{}, nil, "No such session for the user", "TokenCache.RevokeSession/revokeSessions.Run()")
+	}
+	return tc.publishDenied(res, "TokenCache.RevokeSession")
+}
+
+// RevokeAllSessions : logs out the user everywhere, call this when the password changes or the account is removed
+// the tokens are put on the denylist and published, services that verify on their own reject them too
+// ErrCacheQuery : cache could not be queried
+func (tc *TokenCache) RevokeAllSessions(email string) error {
+	val, err := revokeSessions.Run(tc.Client, []string{userKey(email)}, sessPrefix+slotTag(email)).Result()
+	if err != nil {
+		return ex.NewErr(&ex.ErrCacheQuery{}, err, "Failed to revoke sessions", "TokenCache.RevokeAllSessions/revokeSessions.Run()")
+	}
+	res, _ := val.([]interface{})
+	return tc.publishDenied(res, "TokenCache.RevokeAllSessions")
+}
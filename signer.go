@@ -0,0 +1,105 @@
+package auth
+
+/*
+Signing and verification of tokens is pluggable.
+AuthAPI that issues the tokens signs with the private key (or the shared secret)
+while the downstream services verify with only the public key.
+HMAC is still supported, that is what ToString/Parse with a secret string fall back to
+*/
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// Signer : signs the token and gets the string format of it
+type Signer interface {
+	Sign(tok *jwt.Token) (string, error)
+}
+
+// Verifier : gets the key that can verify the token signature
+// implementations are expected to check the algorithm on the token is what they expect
+type Verifier interface {
+	VerifyKey(tok *jwt.Token) (interface{}, error)
+}
+
+// ClaimsVerifier : verifier for token formats other than jwt (PASETO)
+// verifies the token string and hands out the claims, which are then validated just as for jwt
+// VerifyKey on such verifiers is expected to reject all jwts
+type ClaimsVerifier interface {
+	Verifier
+	VerifyClaims(ts TokenStr) (jwt.MapClaims, error)
+}
+
+// KeySigner : signs with a fixed signing method and key
+type KeySigner struct {
+	Method jwt.SigningMethod
+	Key    interface{} // []byte for HMAC, *rsa.PrivateKey, *ecdsa.PrivateKey, ed25519.PrivateKey
+}
+
+// Sign : stamps the signing method on the token and signs it with the key
+func (ks *KeySigner) Sign(tok *jwt.Token) (string, error) {
+	tok.Method = ks.Method
+	tok.Header["alg"] = ks.Method.Alg()
+	return tok.SignedString(ks.Key)
+}
+
+// KeyVerifier : verifies with a fixed signing method and key
+type KeyVerifier struct {
+	Method jwt.SigningMethod
+	Key    interface{} // []byte for HMAC, *rsa.PublicKey, *ecdsa.PublicKey, ed25519.PublicKey
+}
+
+// VerifyKey : hands out the key only if the token was signed with the expected algorithm
+// this is what guards against algorithm confusion - a token signed HS256 using the public key as secret for instance
+func (kv *KeyVerifier) VerifyKey(tok *jwt.Token) (interface{}, error) {
+	if tok.Method == nil || tok.Method.Alg() != kv.Method.Alg() {
+		return nil, newTokErr(ErrTokAlgorithm, nil, "KeyVerifier.VerifyKey")
+	}
+	return kv.Key, nil
+}
+
+// ++++++++++++++++++++++++++++++++ Constructors++++++++++++++++++++++++++++++++++++++++++++
+
+// NewHMACSigner : HS256 signer with the shared secret
+func NewHMACSigner(secret string) *KeySigner {
+	return &KeySigner{Method: jwt.SigningMethodHS256, Key: []byte(secret)}
+}
+
+// NewHMACVerifier : HS256 verifier with the shared secret
+func NewHMACVerifier(secret string) *KeyVerifier {
+	return &KeyVerifier{Method: jwt.SigningMethodHS256, Key: []byte(secret)}
+}
+
+// NewRSASigner : RS256 signer with the private key
+func NewRSASigner(priv *rsa.PrivateKey) *KeySigner {
+	return &KeySigner{Method: jwt.SigningMethodRS256, Key: priv}
+}
+
+// NewRSAVerifier : RS256 verifier with the public key
+func NewRSAVerifier(pub *rsa.PublicKey) *KeyVerifier {
+	return &KeyVerifier{Method: jwt.SigningMethodRS256, Key: pub}
+}
+
+// NewECSigner : ES256 signer with the private key, key has to be on the P-256 curve
+func NewECSigner(priv *ecdsa.PrivateKey) *KeySigner {
+	return &KeySigner{Method: jwt.SigningMethodES256, Key: priv}
+}
+
+// NewECVerifier : ES256 verifier with the public key, key has to be on the P-256 curve
+func NewECVerifier(pub *ecdsa.PublicKey) *KeyVerifier {
+	return &KeyVerifier{Method: jwt.SigningMethodES256, Key: pub}
+}
+
+// NewEdSigner : EdDSA signer with the Ed25519 private key
+func NewEdSigner(priv ed25519.PrivateKey) *KeySigner {
+	return &KeySigner{Method: SigningMethodEdDSA, Key: priv}
+}
+
+// NewEdVerifier : EdDSA verifier with the Ed25519 public key
+func NewEdVerifier(pub ed25519.PublicKey) *KeyVerifier {
+	return &KeyVerifier{Method: SigningMethodEdDSA, Key: pub}
+}
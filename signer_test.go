@@ -0,0 +1,166 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	ex "github.com/eensymachines-in/errx"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAsymmetricSigning(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	edPub, edPriv, _ := ed25519.GenerateKey(rand.Reader)
+	data := []struct {
+		alg string
+		s   Signer
+		v   Verifier
+	}{
+		{"RS256", NewRSASigner(rsaKey), NewRSAVerifier(&rsaKey.PublicKey)},
+		{"ES256", NewECSigner(ecKey), NewECVerifier(&ecKey.PublicKey)},
+		{"EdDSA", NewEdSigner(edPriv), NewEdVerifier(edPub)},
+	}
+	for _, d := range data {
+		authTok := NewToken("kneeru@gmail.com", 2, AuthExp)
+		tokStr, err := authTok.SignWith(d.s)
+		assert.Nil(t, err, "Unexpected error signing the token with %s", d.alg)
+		t.Log(tokStr)
+		tok, err := tokStr.ParseWith(d.v)
+		assert.Nil(t, err, "Unexpected error verifying the token with %s", d.alg)
+		assert.NotNil(t, tok, "Unexpected nil token")
+		assert.Equal(t, d.alg, tok.Header["alg"], "Unexpected algorithm on the token header")
+		assert.Equal(t, authTok.UUID, tok.UUID, "Unexpected mismatch in token uuid")
+	}
+	// token signed with one algorithm cannot be verified by another
+	tokStr, _ := NewToken("kneeru@gmail.com", 2, AuthExp).SignWith(NewEdSigner(edPriv))
+	tok, err := tokStr.ParseWith(NewRSAVerifier(&rsaKey.PublicKey))
+	assert.Nil(t, tok, "Was expecting token to be nil")
+	assert.NotNil(t, err, "Was expecting error when algorithm is unexpected")
+	// HMAC token signed with the public key as secret should not pass EdDSA verification
+	tokStr, _ = NewToken("kneeru@gmail.com", 2, AuthExp).ToString(string(edPub))
+	tok, err = tokStr.ParseWith(NewEdVerifier(edPub))
+	assert.Nil(t, tok, "Was expecting token to be nil")
+	assert.NotNil(t, err, "Was expecting error when algorithm is HMAC")
+}
+
+func TestKeyringRotation(t *testing.T) {
+	oldKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	newKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ring := NewKeyring()
+	assert.Nil(t, ring.Add(&RingKey{KID: "k1", Signer: NewECSigner(oldKey), Verifier: NewECVerifier(&oldKey.PublicKey)}), "Unexpected error adding key")
+	assert.NotNil(t, ring.Add(&RingKey{KID: "k1", Signer: NewECSigner(oldKey), Verifier: NewECVerifier(&oldKey.PublicKey)}), "Was expecting error on duplicate kid")
+	_, err := NewToken("kneeru@gmail.com", 2, AuthExp).SignWith(ring)
+	assert.NotNil(t, err, "Was expecting error when no key is active")
+	assert.Nil(t, ring.Activate("k1"), "Unexpected error activating key")
+
+	oldTokStr, err := NewToken("kneeru@gmail.com", 2, AuthExp).SignWith(ring)
+	assert.Nil(t, err, "Unexpected error signing with the keyring")
+	// rotating the key, older tokens should still verify in the overlap window
+	assert.Nil(t, ring.Add(&RingKey{KID: "k2", Signer: NewECSigner(newKey), Verifier: NewECVerifier(&newKey.PublicKey)}), "Unexpected error adding key")
+	assert.Nil(t, ring.Activate("k2"), "Unexpected error activating key")
+	assert.Equal(t, "k2", ring.Active(), "Unexpected active key")
+	newTokStr, _ := NewToken("kneeru@gmail.com", 2, AuthExp).SignWith(ring)
+	tok, err := oldTokStr.ParseWith(ring)
+	assert.Nil(t, err, "Unexpected error verifying token signed with the retiring key")
+	assert.Equal(t, "k1", tok.Header["kid"], "Unexpected kid on the token")
+	tok, err = newTokStr.ParseWith(ring)
+	assert.Nil(t, err, "Unexpected error verifying token signed with the active key")
+	assert.Equal(t, "k2", tok.Header["kid"], "Unexpected kid on the token")
+	// after the overlap window the retiring key is removed
+	assert.NotNil(t, ring.Remove("k2"), "Was expecting error removing the active key")
+	assert.Nil(t, ring.Remove("k1"), "Unexpected error removing the retiring key")
+	tok, err = oldTokStr.ParseWith(ring)
+	assert.Nil(t, tok, "Was expecting token to be nil")
+	assert.NotNil(t, err, "Was expecting error for token signed with removed key")
+}
+
+func TestJWKSVerifier(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	edPub, edPriv, _ := ed25519.GenerateKey(rand.Reader)
+	ring := NewKeyring()
+	ring.Add(&RingKey{KID: "rsa", Signer: NewRSASigner(rsaKey), Verifier: NewRSAVerifier(&rsaKey.PublicKey)})
+	ring.Add(&RingKey{KID: "ec", Signer: NewECSigner(ecKey), Verifier: NewECVerifier(&ecKey.PublicKey)})
+	ring.Add(&RingKey{KID: "hmac", Signer: NewHMACSigner("secretstring"), Verifier: NewHMACVerifier("secretstring")})
+	assert.Equal(t, 2, len(ring.JWKS().Keys), "Unexpected number of keys published, HMAC keys should be left out")
+
+	srv := httptest.NewServer(JWKSHandler(ring))
+	defer srv.Close()
+	jv := NewJWKSVerifier(srv.URL, 1*time.Minute)
+	for _, kid := range []string{"rsa", "ec"} {
+		assert.Nil(t, ring.Activate(kid), "Unexpected error activating key")
+		tokStr, _ := NewToken("kneeru@gmail.com", 2, AuthExp).SignWith(ring)
+		tok, err := tokStr.ParseWith(jv)
+		assert.Nil(t, err, "Unexpected error verifying token with %s key from JWKS", kid)
+		assert.NotNil(t, tok, "Unexpected nil token")
+	}
+	// HMAC tokens cannot be verified since the secret is never published
+	ring.Activate("hmac")
+	tokStr, _ := NewToken("kneeru@gmail.com", 2, AuthExp).SignWith(ring)
+	_, err := tokStr.ParseWith(jv)
+	assert.NotNil(t, err, "Was expecting error for HMAC token verified over JWKS")
+	// key rotated in after the keys were fetched
+	ring.Add(&RingKey{KID: "ed", Signer: NewEdSigner(edPriv), Verifier: NewEdVerifier(edPub)})
+	ring.Activate("ed")
+	jv.fetched = time.Now().Add(-jwksCooldown)
+	tokStr, _ = NewToken("kneeru@gmail.com", 2, AuthExp).SignWith(ring)
+	_, err = tokStr.ParseWith(jv)
+	assert.Nil(t, err, "Unexpected error verifying token signed with newly rotated key")
+}
+
+func TestJWKSConcurrentFetch(t *testing.T) {
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ring := NewKeyring()
+	ring.Add(&RingKey{KID: "ec", Signer: NewECSigner(ecKey), Verifier: NewECVerifier(&ecKey.PublicKey)})
+	ring.Activate("ec")
+	tokStr, _ := NewToken("kneeru@gmail.com", 2, AuthExp).SignWith(ring)
+
+	// verifications at once wait on the one fetch
+	var fetches int32
+	handler := JWKSHandler(ring)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		<-time.After(100 * time.Millisecond)
+		handler.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+	jv := NewJWKSVerifier(srv.URL, time.Minute)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := tokStr.ParseWith(jv)
+			assert.Nil(t, err, "Unexpected error verifying token")
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&fetches), "Was expecting the keys fetched once")
+}
+
+func TestJWKSOutage(t *testing.T) {
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ring := NewKeyring()
+	ring.Add(&RingKey{KID: "ec", Signer: NewECSigner(ecKey), Verifier: NewECVerifier(&ecKey.PublicKey)})
+	ring.Activate("ec")
+	tokStr, _ := NewToken("kneeru@gmail.com", 2, AuthExp).SignWith(ring)
+
+	// key server down is not a forged token
+	srv := httptest.NewServer(JWKSHandler(ring))
+	srv.Close()
+	_, err := tokStr.ParseWith(NewJWKSVerifier(srv.URL, time.Minute))
+	xe, ok := err.(*ex.ErrConnFailed)
+	if assert.True(t, ok, "Unexpected error %v when the key server is down", err) {
+		assert.Equal(t, http.StatusServiceUnavailable, xe.HTTPStatusCode(), "Unexpected status code")
+	}
+}
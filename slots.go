@@ -0,0 +1,33 @@
+package auth
+
+/*
+TokenCache runs on any redis.UniversalClient - the single node, failover (Sentinel) or cluster client
+login, refresh, status and the sessions are Lua scripts and transactions over many keys
+on a cluster all the keys of one script have to be in the same hash slot, else the script errs with CROSSSLOT
+hence every key of the user carries the same hash tag - {hash of the email} - sessions, tokens, references and the denylist
+the hash and not the email itself, the opaque references carry it to the client (masked)
+*/
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// slotHashLen : length of the hash the keys of the user are tagged with
+const slotHashLen = 16
+
+// slotHash : hash of the email, all the keys of the user are tagged with it
+func slotHash(email string) string {
+	sum := sha256.Sum256([]byte(email))
+	return hex.EncodeToString(sum[:slotHashLen/2])
+}
+
+// slotTag : hash tag that puts the key in the hash slot of the user
+func slotTag(email string) string {
+	return "{" + slotHash(email) + "}"
+}
+
+// tokKey : cache key for the token of the user, by the UUID
+func tokKey(email, uuid string) string {
+	return slotTag(email) + uuid
+}
@@ -0,0 +1,135 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+	"github.com/stretchr/testify/assert"
+)
+
+// keyTag : part of the key that is hashed to the cluster slot
+func keyTag(key string) string {
+	if i := strings.Index(key, "{"); i >= 0 {
+		if j := strings.Index(key[i+1:], "}"); j > 0 {
+			return key[i+1 : i+1+j]
+		}
+	}
+	return key
+}
+
+// slotHook : records the scripts and transactions that span more than one hash slot
+type slotHook struct {
+	mu    sync.Mutex
+	cross []string
+}
+
+// keys : keys the command is on, scripts and the key commands that the cache uses
+func (sh *slotHook) keys(cmd redis.Cmder) []string {
+	args := cmd.Args()
+	result := []string{}
+	switch cmd.Name() {
+	case "eval", "evalsha":
+		n, _ := strconv.Atoi(fmt.Sprint(args[2]))
+		for _, k := range args[3 : 3+n] {
+			result = append(result, fmt.Sprint(k))
+		}
+	case "publish":
+		// channel of the published message, hashed to a slot as a key would be
+		result = append(result, fmt.Sprint(args[1]))
+	case "del", "exists":
+		for _, k := range args[1:] {
+			result = append(result, fmt.Sprint(k))
+		}
+	case "multi", "exec":
+	default:
+		if len(args) > 1 {
+			result = append(result, fmt.Sprint(args[1]))
+		}
+	}
+	return result
+}
+
+// check : records the keys when they are not all in one slot
+func (sh *slotHook) check(keys []string) {
+	for _, k := range keys {
+		if keyTag(k) != keyTag(keys[0]) {
+			sh.mu.Lock()
+			sh.cross = append(sh.cross, strings.Join(keys, " "))
+			sh.mu.Unlock()
+			return
+		}
+	}
+}
+
+func (sh *slotHook) BeforeProcess(ctx context.Context, cmd redis.Cmder) (context.Context, error) {
+	sh.check(sh.keys(cmd))
+	return ctx, nil
+}
+
+func (sh *slotHook) AfterProcess(ctx context.Context, cmd redis.Cmder) error {
+	return nil
+}
+
+func (sh *slotHook) BeforeProcessPipeline(ctx context.Context, cmds []redis.Cmder) (context.Context, error) {
+	keys := []string{}
+	for _, cmd := range cmds {
+		keys = append(keys, sh.keys(cmd)...)
+	}
+	sh.check(keys)
+	return ctx, nil
+}
+
+func (sh *slotHook) AfterProcessPipeline(ctx context.Context, cmds []redis.Cmder) error {
+	return nil
+}
+
+func TestHashSlots(t *testing.T) {
+	cac := testCache(t)
+	defer cac.Close()
+	hook := &slotHook{}
+	cac.Client.AddHook(hook)
+	cac.OnEvent = func(*TokEvent) {}
+	email := fmt.Sprintf("slots%d@gmail.com", time.Now().UnixNano())
+
+	for _, opaque := range []bool{false, true} {
+		cac.Opaque = opaque
+		cac.Verifier = NewHMACVerifier("secretstring")
+		pair, refreshed := &TokenPair{}, &TokenPair{}
+		assert.Nil(t, cac.LoginUser(email, 2, pair, LoginMeta(SessionMeta{IP: "10.0.0.1"})), "Unexpected error logging in")
+		assert.Nil(t, cac.TokenStatus(pair.Auth), "Unexpected error getting token status")
+		tokStr, _ := pair.Auth.ToString("secretstring")
+		if opaque {
+			tokStr = TokenStr(pair.Auth.Ref)
+			cac.Verifier = nil
+			_, err := cac.ParseRef(tokStr)
+			assert.Nil(t, err, "Unexpected error parsing reference")
+		}
+		_, _, err := cac.Verify(tokStr, email)
+		assert.Nil(t, err, "Unexpected error verifying token")
+		cac.Policy = &TokenPolicy{Grace: time.Minute}
+		assert.Nil(t, cac.RefreshUser(pair.Refr, refreshed), "Unexpected error refreshing")
+		assert.Nil(t, cac.RefreshUser(pair.Refr, &TokenPair{}), "Unexpected error retrying the refresh")
+		cac.Policy = nil
+		assert.NotNil(t, cac.RefreshUser(pair.Refr, &TokenPair{}), "Was expecting the reuse to be caught")
+		second := &TokenPair{}
+		assert.Nil(t, cac.LoginUser(email, 2, second), "Unexpected error logging in")
+		_, err = cac.ListSessions(email)
+		assert.Nil(t, err, "Unexpected error listing sessions")
+		_, err = cac.GetSession(email, second.Auth.Session)
+		assert.Nil(t, err, "Unexpected error getting session")
+		assert.Nil(t, cac.LogoutToken(second.Auth), "Unexpected error logging out")
+		assert.Nil(t, cac.RevokeSession(email, second.Auth.Session), "Unexpected error revoking session")
+		assert.Nil(t, cac.LogoutToken(second.Refr), "Unexpected error logging out")
+		assert.Nil(t, cac.RevokeAllSessions(email), "Unexpected error revoking sessions")
+	}
+	assert.Empty(t, hook.cross, "Commands across hash slots would fail on a cluster")
+	ref, err := cac.newRef(email)
+	assert.Nil(t, err, "Unexpected error getting a reference")
+	assert.Equal(t, keyTag(tokKey(email, "someuuid")), keyTag(cac.refKey(ref)), "Reference should be in the slot of the user")
+}
@@ -0,0 +1,399 @@
+package auth
+
+/*
+TokenStore is what the APIs need of the server side sessions - login, refresh, status and logout
+TokenCache is the redis implementation, MemStore keeps it all in memory
+MemStore is for the tests and single node deployments, sessions are lost when the process exits
+*/
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	ex "github.com/eensymachines-in/errx"
+)
+
+// TokenStore : server side sessions for the tokens
+type TokenStore interface {
+	LoginUser(email string, role int, result *TokenPair, opts ...LoginOption) error
+	RefreshUser(refr *JWTok, result *TokenPair, scopes ...string) error
+	TokenStatus(tok *JWTok) error
+	LogoutToken(tok *JWTok) error
+}
+
+var (
+	_ TokenStore = &TokenCache{}
+	_ TokenStore = &MemStore{}
+)
+
+// memItem : value in the MemStore with the time it expires at
+type memItem struct {
+	val  string
+	keys map[string]bool // keys in the session when the item is a session, the pair issued for the refr token when a used marker
+	at   time.Time       // time the refr token was used, only when the item is a used marker
+	exp  time.Time
+}
+
+// MemStore : in memory TokenStore, safe for concurrent use
+// items expire just as they would in the cache, expired items and sessions are purged on every login
+// opaque tokens are not supported
+type MemStore struct {
+	Issuer   string          // iss claim on all the tokens that are logged in
+	Audience []string        // aud claim on all the tokens that are logged in
+	OnEvent  func(*TokEvent) // events for auditing, logged when not set
+	Policy   *TokenPolicy    // lifetimes of the tokens, AuthExp and RefrExp when not set
+	mu       sync.Mutex
+	items    map[string]*memItem
+	users    map[string]map[string]*Session // sessions of the user by the sid, with the metadata
+}
+
+// NewMemStore : empty in memory store
+func NewMemStore() *MemStore {
+	return &MemStore{items: map[string]*memItem{}}
+}
+
+// get : value for the key, if not expired
+// call with the lock held
+func (ms *MemStore) get(key string) (string, bool) {
+	item, ok := ms.items[key]
+	if !ok {
+		return "", false
+	}
+	if !time.Now().Before(item.exp) {
+		delete(ms.items, key)
+		return "", false
+	}
+	return item.val, true
+}
+
+// setNX : sets the value for the key only if not set already, value expires after ttl
+// call with the lock held
+func (ms *MemStore) setNX(key, val string, ttl time.Duration) bool {
+	if _, ok := ms.get(key); ok {
+		return false
+	}
+	if ms.items == nil {
+		ms.items = map[string]*memItem{}
+	}
+	ms.items[key] = &memItem{val: val, exp: time.Now().Add(ttl)}
+	return true
+}
+
+// sessAdd : adds the keys to the session of the user, session lives as long as the longest lived key in it
+// call with the lock held
+func (ms *MemStore) sessAdd(email, sid string, ttl time.Duration, keys ...string) {
+	if _, ok := ms.get(sessKey(email, sid)); !ok {
+		ms.items[sessKey(email, sid)] = &memItem{keys: map[string]bool{}}
+	}
+	sess := ms.items[sessKey(email, sid)]
+	for _, k := range keys {
+		sess.keys[k] = true
+	}
+	if exp := time.Now().Add(ttl); exp.After(sess.exp) {
+		sess.exp = exp
+	}
+}
+
+// sessRevoke : removes all the keys in the session of the user and the session itself
+// call with the lock held
+func (ms *MemStore) sessRevoke(email, sid string) {
+	if sess, ok := ms.items[sessKey(email, sid)]; ok {
+		for k := range sess.keys {
+			delete(ms.items, k)
+		}
+	}
+	delete(ms.items, sessKey(email, sid))
+}
+
+// purge : removes all the expired items, and the sessions that have expired with them
+// session expires with the last token in it, or when it idles out or reaches the cap
+// call with the lock held
+func (ms *MemStore) purge() {
+	now := time.Now()
+	for k, item := range ms.items {
+		if !now.Before(item.exp) {
+			delete(ms.items, k)
+		}
+	}
+	for email, sessions := range ms.users {
+		for sid := range sessions {
+			if _, ok := ms.alive(email, sid); !ok {
+				ms.sessRevoke(email, sid)
+			}
+		}
+		if len(sessions) == 0 {
+			delete(ms.users, email)
+		}
+	}
+}
+
+// alive : session of the user if it is yet to expire, idle out or reach the cap - else it is forgotten
+// call with the lock held
+func (ms *MemStore) alive(email, sid string) (*Session, bool) {
+	sess, ok := ms.users[email][sid]
+	if !ok {
+		return nil, false
+	}
+	now := time.Now()
+	_, ok = ms.get(sessKey(email, sid))
+	if ok && sess.Idle > 0 {
+		ok = now.Before(sess.LastSeen.Add(sess.Idle))
+	}
+	if ok && !sess.Expires.IsZero() {
+		ok = now.Before(sess.Expires)
+	}
+	if !ok {
+		delete(ms.users[email], sid)
+		return nil, false
+	}
+	return sess, true
+}
+
+// enforce : makes way for a login under the limit on the sessions of the user
+// returns the sids of the sessions evicted, oldest first
+// ErrInsuffPrivlg : user already has as many sessions as the limit, and the limit rejects new logins
+// call with the lock held
+func (ms *MemStore) enforce(email string, limit SessionLimit) ([]string, error) {
+	if limit.Max <= 0 {
+		return nil, nil
+	}
+	live := []*Session{}
+	for sid := range ms.users[email] {
+		if sess, ok := ms.alive(email, sid); ok {
+			live = append(live, sess)
+		}
+	}
+	if len(live) < limit.Max {
+		return nil, nil
+	}
+	if limit.Policy != EvictOldest {
+		return nil, ex.NewErr(&ex.ErrInsuffPrivlg{}, nil, "Too many sessions, logout from one of the other devices and try again", "MemStore.LoginUser/ms.enforce()")
+	}
+	sort.Slice(live, func(i, j int) bool {
+		return live[i].Created.Before(live[j].Created)
+	})
+	evicted := []string{}
+	for _, sess := range live[:len(live)-limit.Max+1] {
+		ms.sessRevoke(email, sess.ID)
+		delete(ms.users[email], sess.ID)
+		evicted = append(evicted, sess.ID)
+	}
+	return evicted, nil
+}
+
+// login : creates the 2 tokens and loads them in the store, returns the pair and the sids of the sessions evicted for it
+// ErrInsuffPrivlg : user already has as many sessions as the limit, and the limit rejects new logins
+// ErrTokenExpired : session is not new and is gone - revoked, expired, idled out or reached the cap
+// call with the lock held
+func (ms *MemStore) login(email string, role int, opts []LoginOption) (*TokenPair, []string, error) {
+	conf := newLoginConf(opts)
+	lt := ms.Policy.lifetime(role, conf.client, conf.lifetime)
+	pair := conf.newPair(email, role, ms.Issuer, ms.Audience, lt)
+	ms.purge()
+	if !conf.fresh {
+		if _, ok := ms.alive(email, conf.session); !ok {
+			return nil, nil, ex.NewErr(&ex.ErrTokenExpired{}, nil, "Login has expired, login again", "MemStore.login/ms.alive()")
+		}
+	}
+	evicted, err := ms.enforce(email, conf.sessLimit(ms.Policy, role))
+	if err != nil {
+		return nil, nil, err
+	}
+	ms.setNX(pair.Auth.UUID, pair.Refr.UUID, pair.Auth.Exp)
+	ms.setNX(pair.Refr.UUID, pair.Refr.User, pair.Refr.Exp)
+	ms.sessAdd(email, conf.session, pair.Refr.Exp, pair.Auth.UUID, pair.Refr.UUID)
+	if ms.users == nil {
+		ms.users = map[string]map[string]*Session{}
+	}
+	if ms.users[email] == nil {
+		ms.users[email] = map[string]*Session{}
+	}
+	sess, ok := ms.users[email][conf.session]
+	if !ok {
+		sess = &Session{ID: conf.session, User: email, Created: time.Now()}
+		ms.users[email][conf.session] = sess
+	}
+	if conf.fresh {
+		if conf.meta != nil {
+			sess.SessionMeta = *conf.meta
+		}
+		sess.Idle = lt.Idle
+		if lt.Max > 0 {
+			sess.Expires = sess.Created.Add(lt.Max)
+		}
+	}
+	sess.LastSeen = time.Now()
+	return pair, evicted, nil
+}
+
+// LoginUser : creates the 2 tokens and loads them in the store, same as TokenCache.LoginUser
+// opts : scopes granted to the login, metadata of the session, type of client and lifetimes
+// ErrInsuffPrivlg : user already has as many sessions as the limit, and the limit rejects new logins
+func (ms *MemStore) LoginUser(email string, role int, result *TokenPair, opts ...LoginOption) error {
+	ms.mu.Lock()
+	pair, evicted, err := ms.login(email, role, opts)
+	ms.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	for _, sid := range evicted {
+		emitEvent(ms.OnEvent, &TokEvent{Kind: EvtSessionEvicted, User: email, Session: sid})
+	}
+	*result = *pair
+	return nil
+}
+
+// RefreshUser : uses the refr token to generate a new pair of tokens, same as TokenCache.RefreshUser
+// the refr token is used up and the new pair issued under the one lock
+// TokErr : token is the auth token of a pair, ErrTokClaims
+// ErrInsuffPrivlg : scope asked for was never granted to the refr token
+// ErrTokenExpired : refr token has expired, was logged out or was already used, or the session has idled out or reached the cap
+// when already used after the grace, the whole session is revoked and EvtRefrReuse is emitted, within the grace EvtRefrRetry
+func (ms *MemStore) RefreshUser(refr *JWTok, result *TokenPair, scopes ...string) error {
+	opts, err := refreshOpts(refr, scopes, "MemStore.RefreshUser")
+	if err != nil {
+		return err
+	}
+	ms.mu.Lock()
+	now := time.Now()
+	retry := false
+	if _, ok := ms.get(refr.UUID); !ok {
+		used, ok := ms.items[usedKey(refr.User, refr.UUID)]
+		if !ok || !now.Before(used.exp) {
+			ms.mu.Unlock()
+			return ex.NewErr(&ex.ErrTokenExpired{}, nil, "Login has expired, login again", "MemStore.RefreshUser/ms.get()")
+		}
+		if grace := ms.Policy.grace(); grace <= 0 || now.Sub(used.at) > grace {
+			ms.sessRevoke(refr.User, refr.Session)
+			ms.mu.Unlock()
+			emitEvent(ms.OnEvent, &TokEvent{Kind: EvtRefrReuse, User: refr.User, Session: refr.Session, UUID: refr.UUID})
+			return ex.NewErr(&ex.ErrTokenExpired{}, nil, "Login has been revoked, login again", "MemStore.RefreshUser/ms.get()")
+		}
+		// retry within the grace, the pair issued before never reached the client
+		retry = true
+	}
+	if refr.Session != "" {
+		sess, ok := ms.alive(refr.User, refr.Session)
+		if !ok {
+			ms.mu.Unlock()
+			return ex.NewErr(&ex.ErrTokenExpired{}, nil, "Login has expired, login again", "MemStore.RefreshUser/ms.alive()")
+		}
+		opts = append(opts, loginSession(refr.Session, sess.Expires))
+	}
+	pair, _, err := ms.login(refr.User, refr.Role, opts)
+	if err != nil {
+		ms.mu.Unlock()
+		return err
+	}
+	used, ok := ms.items[usedKey(refr.User, refr.UUID)]
+	if retry && ok {
+		for k := range used.keys {
+			delete(ms.items, k)
+		}
+	} else {
+		delete(ms.items, refr.UUID)
+		used = &memItem{val: "1", at: now, exp: now.Add(refr.Exp)}
+		ms.items[usedKey(refr.User, refr.UUID)] = used
+	}
+	used.keys = map[string]bool{pair.Auth.UUID: true, pair.Refr.UUID: true}
+	ms.mu.Unlock()
+	if retry {
+		emitEvent(ms.OnEvent, &TokEvent{Kind: EvtRefrRetry, User: refr.User, Session: refr.Session, UUID: refr.UUID})
+	}
+	*result = *pair
+	return nil
+}
+
+// TokenStatus : denotes the state of the token in the store
+// session of the token is marked seen, which extends the idle timeout
+// ErrTokenExpired : token has expired or was logged out, or the session has idled out or reached the cap
+func (ms *MemStore) TokenStatus(tok *JWTok) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if _, ok := ms.get(tok.UUID); !ok {
+		return ex.NewErr(&ex.ErrTokenExpired{}, nil, "Failed to get auth status", "MemStore.TokenStatus/ms.get()")
+	}
+	if tok.Session != "" {
+		sess, ok := ms.alive(tok.User, tok.Session)
+		if !ok {
+			return ex.NewErr(&ex.ErrTokenExpired{}, nil, "Failed to get auth status", "MemStore.TokenStatus/ms.alive()")
+		}
+		sess.LastSeen = time.Now()
+	}
+	return nil
+}
+
+// LogoutToken : removes the token from the store permanently
+// when it was the last token of its session, the session ends
+func (ms *MemStore) LogoutToken(tok *JWTok) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	delete(ms.items, tok.UUID)
+	if sess, ok := ms.items[sessKey(tok.User, tok.Session)]; ok && tok.Session != "" {
+		for k := range sess.keys {
+			if _, ok := ms.get(k); ok {
+				return nil
+			}
+		}
+		ms.sessRevoke(tok.User, tok.Session)
+		delete(ms.users[tok.User], tok.Session)
+	}
+	return nil
+}
+
+// ListSessions : sessions of the user that are yet to expire, oldest first
+func (ms *MemStore) ListSessions(email string) ([]*Session, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	result := []*Session{}
+	for sid := range ms.users[email] {
+		sess, ok := ms.alive(email, sid)
+		if !ok {
+			continue
+		}
+		cp := *sess
+		result = append(result, &cp)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Created.Before(result[j].Created)
+	})
+	return result, nil
+}
+
+// GetSession : session of the user with the metadata
+// ErrNotFound : user has no such session, or it has expired or idled out
+func (ms *MemStore) GetSession(email, id string) (*Session, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	sess, ok := ms.alive(email, id)
+	if !ok {
+		return nil, ex.NewErr(&ex.ErrNotFound{}, nil, "No such session for the user", "MemStore.GetSession")
+	}
+	cp := *sess
+	return &cp, nil
+}
+
+// RevokeSession : logs out all the tokens in the session of the user
+// ErrNotFound : user has no such session
+func (ms *MemStore) RevokeSession(email, id string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if _, ok := ms.users[email][id]; !ok {
+		return ex.NewErr(&ex.ErrNotFound{}, nil, "No such session for the user", "MemStore.RevokeSession")
+	}
+	ms.sessRevoke(email, id)
+	delete(ms.users[email], id)
+	return nil
+}
+
+// RevokeAllSessions : logs out the user everywhere, call this when the password changes or the account is removed
+func (ms *MemStore) RevokeAllSessions(email string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	for sid := range ms.users[email] {
+		ms.sessRevoke(email, sid)
+	}
+	delete(ms.users, email)
+	return nil
+}
@@ -0,0 +1,456 @@
+package auth
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	ex "github.com/eensymachines-in/errx"
+	"github.com/go-redis/redis/v7"
+	"github.com/stretchr/testify/assert"
+)
+
+// testStores : stores the common tests are run against, cache is left out when it isnt up
+func testStores(t *testing.T) map[string]TokenStore {
+	result := map[string]TokenStore{"mem": NewMemStore()}
+	cac := &TokenCache{Client: redis.NewClient(&redis.Options{Addr: "localhost:6379"})}
+	if err := cac.Ping(); err != nil {
+		t.Logf("Cache isnt up, testing only in memory: %s", err)
+		cac.Close()
+		return result
+	}
+	t.Cleanup(cac.Close)
+	result["redis"] = cac
+	return result
+}
+
+func TestTokenStore(t *testing.T) {
+	for name, store := range testStores(t) {
+		result := &TokenPair{}
+		assert.Nil(t, store.LoginUser("kneeru@gmail.com", 2, result, LoginScopes("devices:lock", "devices:read")), "Unexpected error logging in: %s", name)
+		assert.Nil(t, store.TokenStatus(result.Auth), "Unexpected error on auth token status: %s", name)
+		assert.Nil(t, store.TokenStatus(result.Refr), "Unexpected error on refr token status: %s", name)
+
+		refreshed := &TokenPair{}
+		assert.NotNil(t, store.RefreshUser(result.Refr, refreshed, "users:delete"), "Was expecting error refreshing with scope never granted: %s", name)
+		assert.Nil(t, store.RefreshUser(result.Refr, refreshed, "devices:read"), "Unexpected error refreshing: %s", name)
+		assert.Equal(t, []string{"devices:read"}, refreshed.Auth.Scopes, "Unexpected scopes on refreshed auth token: %s", name)
+		assert.NotNil(t, store.TokenStatus(result.Refr), "Refr token should be logged out once used: %s", name)
+		assert.Nil(t, store.TokenStatus(refreshed.Auth), "Unexpected error on refreshed auth token status: %s", name)
+
+		assert.Nil(t, store.LogoutToken(refreshed.Auth), "Unexpected error logging out: %s", name)
+		err := store.TokenStatus(refreshed.Auth)
+		_, ok := err.(*ex.ErrTokenExpired)
+		assert.True(t, ok, "Unexpected error %v on logged out token: %s", err, name)
+		store.LogoutToken(refreshed.Refr)
+		store.LogoutToken(result.Auth)
+	}
+}
+
+func TestTokenStoreExpiry(t *testing.T) {
+	stores := testStores(t)
+	pairs := map[string]*TokenPair{}
+	for name, store := range stores {
+		pairs[name] = &TokenPair{}
+		assert.Nil(t, store.LoginUser("kneeru@gmail.com", 2, pairs[name], LoginLifetime(1*time.Second, 3*time.Second)), "Unexpected error logging in: %s", name)
+	}
+	<-time.After(1500 * time.Millisecond)
+	for name, store := range stores {
+		assert.NotNil(t, store.TokenStatus(pairs[name].Auth), "Auth token should have expired: %s", name)
+		assert.Nil(t, store.TokenStatus(pairs[name].Refr), "Refr token should not have expired: %s", name)
+		store.LogoutToken(pairs[name].Refr)
+	}
+}
+
+func TestTokenPolicy(t *testing.T) {
+	policy := &TokenPolicy{
+		Default: Lifetime{Auth: 60 * time.Second, Refr: 120 * time.Second},
+		Roles:   map[int]Lifetime{0: {Auth: 30 * time.Second, Refr: 60 * time.Second}},
+		Clients: map[string]Lifetime{"device": {Refr: 24 * time.Hour}},
+	}
+	data := []struct {
+		role     int
+		client   string
+		explicit Lifetime
+		expected Lifetime
+	}{
+		{2, "", Lifetime{}, Lifetime{Auth: 60 * time.Second, Refr: 120 * time.Second}},
+		{0, "", Lifetime{}, Lifetime{Auth: 30 * time.Second, Refr: 60 * time.Second}},
+		{2, "device", Lifetime{}, Lifetime{Auth: 60 * time.Second, Refr: 24 * time.Hour}},
+		{0, "device", Lifetime{}, Lifetime{Auth: 30 * time.Second, Refr: 24 * time.Hour}},
+		{2, "device", Lifetime{Auth: 10 * time.Second}, Lifetime{Auth: 10 * time.Second, Refr: 24 * time.Hour}},
+		{2, "", Lifetime{Auth: 10 * time.Minute}, Lifetime{Auth: 10 * time.Minute, Refr: 10 * time.Minute}}, // refr never shorter than auth
+		{2, "", Lifetime{Idle: time.Minute, Max: 90 * time.Second}, Lifetime{Auth: 60 * time.Second, Refr: 90 * time.Second, Idle: time.Minute, Max: 90 * time.Second}},
+	}
+	for _, d := range data {
+		assert.Equal(t, d.expected, policy.lifetime(d.role, d.client, d.explicit), "Unexpected lifetime for role %d client %q", d.role, d.client)
+	}
+	var none *TokenPolicy
+	assert.Equal(t, Lifetime{Auth: AuthExp, Refr: RefrExp}, none.lifetime(2, "web", Lifetime{}), "Was expecting the defaults without a policy")
+
+	for name, store := range testStores(t) {
+		switch s := store.(type) {
+		case *MemStore:
+			s.Policy = policy
+		case *TokenCache:
+			s.Policy = policy
+		}
+		pair, refreshed := &TokenPair{}, &TokenPair{}
+		assert.Nil(t, store.LoginUser("kneeru@gmail.com", 2, pair, LoginClient("device")), "Unexpected error logging in: %s", name)
+		assert.Equal(t, "device", pair.Refr.Client, "Unexpected client on token: %s", name)
+		assert.Equal(t, 24*time.Hour, pair.Refr.Exp, "Unexpected lifetime of refr token: %s", name)
+		tokStr, _ := pair.Refr.ToString("secretstring")
+		refr, err := tokStr.Parse("secretstring")
+		if assert.Nil(t, err, "Unexpected error parsing refr token: %s", name) {
+			assert.Equal(t, "device", refr.Client, "Client should be read back from the token: %s", name)
+			assert.Nil(t, store.RefreshUser(refr, refreshed), "Unexpected error refreshing: %s", name)
+			assert.Equal(t, 24*time.Hour, refreshed.Refr.Exp, "Refresh should have the lifetime of the client: %s", name)
+			assert.Equal(t, 60*time.Second, refreshed.Auth.Exp, "Unexpected lifetime of auth token: %s", name)
+			store.LogoutToken(refreshed.Auth)
+			store.LogoutToken(refreshed.Refr)
+		}
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	policy := &TokenPolicy{
+		Default: Lifetime{Auth: 5 * time.Second, Refr: 10 * time.Second, Idle: 400 * time.Millisecond},
+		Clients: map[string]Lifetime{"kiosk": {Idle: 10 * time.Second, Max: 1500 * time.Millisecond}},
+	}
+	for name, store := range testStores(t) {
+		switch s := store.(type) {
+		case *MemStore:
+			s.Policy = policy
+		case *TokenCache:
+			s.Policy = policy
+		}
+		reg := store.(SessionRegistry)
+		email := fmt.Sprintf("idle%d@gmail.com", time.Now().UnixNano())
+		// idle timeout keeps active sessions on
+		pair := &TokenPair{}
+		assert.Nil(t, store.LoginUser(email, 2, pair), "Unexpected error logging in: %s", name)
+		for i := 0; i < 3; i++ {
+			<-time.After(250 * time.Millisecond)
+			assert.Nil(t, store.TokenStatus(pair.Auth), "Active session should not idle out: %s", name)
+		}
+		sess, err := reg.GetSession(email, pair.Auth.Session)
+		if assert.Nil(t, err, "Unexpected error getting session: %s", name) {
+			assert.Equal(t, 400*time.Millisecond, sess.Idle, "Unexpected idle timeout on session: %s", name)
+			assert.True(t, sess.Expires.IsZero(), "Was expecting no cap on the session: %s", name)
+		}
+		<-time.After(600 * time.Millisecond)
+		err = store.TokenStatus(pair.Auth)
+		_, ok := err.(*ex.ErrTokenExpired)
+		assert.True(t, ok, "Unexpected error %v on idle session: %s", err, name)
+		err = store.RefreshUser(pair.Refr, &TokenPair{})
+		_, ok = err.(*ex.ErrTokenExpired)
+		assert.True(t, ok, "Unexpected error %v refreshing idle session: %s", err, name)
+		sessions, _ := reg.ListSessions(email)
+		assert.Empty(t, sessions, "Idle session should not be listed: %s", name)
+
+		// cap on the session is recorded at login, refreshes never go beyond it
+		pair, refreshed := &TokenPair{}, &TokenPair{}
+		assert.Nil(t, store.LoginUser(email, 2, pair, LoginClient("kiosk")), "Unexpected error logging in: %s", name)
+		assert.Equal(t, 1500*time.Millisecond, pair.Refr.Exp, "Refr token should not outlive the cap: %s", name)
+		<-time.After(500 * time.Millisecond)
+		assert.Nil(t, store.RefreshUser(pair.Refr, refreshed), "Unexpected error refreshing: %s", name)
+		assert.True(t, refreshed.Auth.Exp <= time.Second, "Refreshed token %s should not outlive the cap: %s", refreshed.Auth.Exp, name)
+		<-time.After(1100 * time.Millisecond)
+		assert.NotNil(t, store.TokenStatus(refreshed.Refr), "Session should have reached the cap: %s", name)
+		assert.NotNil(t, store.RefreshUser(refreshed.Refr, &TokenPair{}), "Session should have reached the cap: %s", name)
+	}
+}
+
+func TestMemStoreConcurrent(t *testing.T) {
+	store := NewMemStore()
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			result, refreshed := &TokenPair{}, &TokenPair{}
+			assert.Nil(t, store.LoginUser("kneeru@gmail.com", 2, result), "Unexpected error logging in")
+			assert.Nil(t, store.TokenStatus(result.Auth), "Unexpected error on token status")
+			assert.Nil(t, store.RefreshUser(result.Refr, refreshed), "Unexpected error refreshing")
+			assert.Nil(t, store.LogoutToken(refreshed.Auth), "Unexpected error logging out")
+		}()
+	}
+	wg.Wait()
+}
+
+func TestMemStorePurge(t *testing.T) {
+	store := NewMemStore()
+	store.Policy = &TokenPolicy{Default: Lifetime{Auth: 20 * time.Millisecond, Refr: 40 * time.Millisecond}}
+	for i := 0; i < 100; i++ {
+		email := fmt.Sprintf("purge%d@gmail.com", i)
+		result, refreshed := &TokenPair{}, &TokenPair{}
+		assert.Nil(t, store.LoginUser(email, 2, result), "Unexpected error logging in")
+		assert.Nil(t, store.RefreshUser(result.Refr, refreshed), "Unexpected error refreshing")
+	}
+	<-time.After(60 * time.Millisecond)
+	assert.Nil(t, store.LoginUser("kneeru@gmail.com", 2, &TokenPair{}, LoginLifetime(time.Minute, time.Minute)), "Unexpected error logging in")
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	// the one login left - 2 tokens and the session
+	assert.Equal(t, 3, len(store.items), "Expired tokens and sessions should be purged")
+	assert.Equal(t, 1, len(store.users), "Users with all sessions expired should be purged")
+}
+
+func TestRefreshReuse(t *testing.T) {
+	for name, store := range testStores(t) {
+		events := []*TokEvent{}
+		onEvent := func(ev *TokEvent) { events = append(events, ev) }
+		policy := &TokenPolicy{Grace: 50 * time.Millisecond}
+		switch s := store.(type) {
+		case *TokenCache:
+			s.OnEvent, s.Policy = onEvent, policy
+		case *MemStore:
+			s.OnEvent, s.Policy = onEvent, policy
+		}
+		login, first, second := &TokenPair{}, &TokenPair{}, &TokenPair{}
+		assert.Nil(t, store.LoginUser("kneeru@gmail.com", 2, login), "Unexpected error logging in: %s", name)
+		assert.NotEmpty(t, login.Refr.Session, "Was expecting the session on the tokens: %s", name)
+		assert.Equal(t, login.Auth.Session, login.Refr.Session, "Tokens of the login should be in the same session: %s", name)
+		assert.Nil(t, store.RefreshUser(login.Refr, first), "Unexpected error refreshing: %s", name)
+		assert.Nil(t, store.RefreshUser(first.Refr, second), "Unexpected error refreshing again: %s", name)
+		assert.Equal(t, login.Refr.Session, second.Refr.Session, "Refreshed tokens should stay in the same session: %s", name)
+		assert.Empty(t, events, "Unexpected events when refreshing: %s", name)
+
+		// reuse of the very first refr token after the grace revokes all that descended from it
+		<-time.After(60 * time.Millisecond)
+		err := store.RefreshUser(login.Refr, &TokenPair{})
+		_, ok := err.(*ex.ErrTokenExpired)
+		assert.True(t, ok, "Unexpected error %v reusing refr token: %s", err, name)
+		if assert.Equal(t, 1, len(events), "Was expecting an event on reuse: %s", name) {
+			assert.Equal(t, EvtRefrReuse, events[0].Kind, "Unexpected event kind: %s", name)
+			assert.Equal(t, login.Refr.UUID, events[0].UUID, "Unexpected token on the event: %s", name)
+			assert.Equal(t, login.Refr.Session, events[0].Session, "Unexpected session on the event: %s", name)
+		}
+		assert.NotNil(t, store.TokenStatus(second.Auth), "Auth token of the session should be revoked: %s", name)
+		assert.NotNil(t, store.TokenStatus(second.Refr), "Refr token of the session should be revoked: %s", name)
+		assert.NotNil(t, store.RefreshUser(second.Refr, &TokenPair{}), "Revoked refr token cannot be refreshed: %s", name)
+
+		// other sessions of the user are left alone, logged out refr tokens are not reuse
+		other := &TokenPair{}
+		assert.Nil(t, store.LoginUser("kneeru@gmail.com", 2, other), "Unexpected error logging in: %s", name)
+		assert.Nil(t, store.TokenStatus(other.Auth), "Other session should not be revoked: %s", name)
+		assert.Nil(t, store.LogoutToken(other.Refr), "Unexpected error logging out: %s", name)
+		events = events[:0]
+		assert.NotNil(t, store.RefreshUser(other.Refr, &TokenPair{}), "Logged out refr token cannot be refreshed: %s", name)
+		assert.Empty(t, events, "Logged out refr token is not reuse: %s", name)
+		assert.Nil(t, store.TokenStatus(other.Auth), "Logged out refr token should not revoke the session: %s", name)
+		store.LogoutToken(other.Auth)
+	}
+}
+
+func TestRefreshRetry(t *testing.T) {
+	for name, store := range testStores(t) {
+		events := []*TokEvent{}
+		onEvent := func(ev *TokEvent) { events = append(events, ev) }
+		policy := &TokenPolicy{Grace: 100 * time.Millisecond, Default: Lifetime{Max: time.Hour}}
+		switch s := store.(type) {
+		case *TokenCache:
+			s.OnEvent, s.Policy = onEvent, policy
+		case *MemStore:
+			s.OnEvent, s.Policy = onEvent, policy
+		}
+		reg := store.(SessionRegistry)
+		email := fmt.Sprintf("retry%d@gmail.com", time.Now().UnixNano())
+		login, lost, retried := &TokenPair{}, &TokenPair{}, &TokenPair{}
+		assert.Nil(t, store.LoginUser(email, 2, login), "Unexpected error logging in: %s", name)
+		assert.Nil(t, store.RefreshUser(login.Refr, lost), "Unexpected error refreshing: %s", name)
+
+		// response with the new pair was lost, the client retries within the grace
+		assert.Nil(t, store.RefreshUser(login.Refr, retried), "Retry within the grace should get a new pair: %s", name)
+		if assert.Equal(t, 1, len(events), "Was expecting an event on retry: %s", name) {
+			assert.Equal(t, EvtRefrRetry, events[0].Kind, "Retry is not reuse: %s", name)
+			assert.Equal(t, login.Refr.UUID, events[0].UUID, "Unexpected token on the event: %s", name)
+		}
+		assert.Equal(t, login.Refr.Session, retried.Refr.Session, "Retry should stay in the session: %s", name)
+		assert.NotNil(t, store.TokenStatus(lost.Auth), "Pair issued before the retry should be gone: %s", name)
+		assert.NotNil(t, store.RefreshUser(lost.Refr, &TokenPair{}), "Pair issued before the retry should be gone: %s", name)
+		assert.Nil(t, store.TokenStatus(retried.Auth), "Unexpected error getting token status: %s", name)
+		sess, err := reg.GetSession(email, login.Refr.Session)
+		if assert.Nil(t, err, "Unexpected error getting session: %s", name) {
+			assert.WithinDuration(t, sess.Created.Add(time.Hour), sess.Expires, time.Second, "Cap on the session should be kept: %s", name)
+		}
+
+		// revoked session is not brought back by a refresh
+		assert.Nil(t, reg.RevokeSession(email, login.Refr.Session), "Unexpected error revoking session: %s", name)
+		assert.NotNil(t, store.RefreshUser(retried.Refr, &TokenPair{}), "Revoked session cannot be refreshed: %s", name)
+		_, err = reg.GetSession(email, login.Refr.Session)
+		assert.NotNil(t, err, "Revoked session should stay gone: %s", name)
+
+		// without a grace the refr token is good for exactly one use
+		switch s := store.(type) {
+		case *TokenCache:
+			s.Policy = nil
+		case *MemStore:
+			s.Policy = nil
+		}
+		events = events[:0]
+		assert.Nil(t, store.LoginUser(email, 2, login), "Unexpected error logging in: %s", name)
+		assert.Nil(t, store.RefreshUser(login.Refr, lost), "Unexpected error refreshing: %s", name)
+		err = store.RefreshUser(login.Refr, &TokenPair{})
+		_, ok := err.(*ex.ErrTokenExpired)
+		assert.True(t, ok, "Unexpected error %v reusing refr token without a grace: %s", err, name)
+		if assert.Equal(t, 1, len(events), "Was expecting an event on reuse: %s", name) {
+			assert.Equal(t, EvtRefrReuse, events[0].Kind, "Reuse without a grace is not a retry: %s", name)
+		}
+		assert.NotNil(t, store.TokenStatus(lost.Auth), "Session should be revoked on reuse: %s", name)
+	}
+}
+
+func TestSessions(t *testing.T) {
+	for name, store := range testStores(t) {
+		reg := store.(SessionRegistry)
+		email := fmt.Sprintf("sessions%d@gmail.com", time.Now().UnixNano())
+		first, second, refreshed := &TokenPair{}, &TokenPair{}, &TokenPair{}
+		assert.Nil(t, store.LoginUser(email, 2, first), "Unexpected error logging in: %s", name)
+		<-time.After(5 * time.Millisecond)
+		assert.Nil(t, store.LoginUser(email, 2, second), "Unexpected error logging in: %s", name)
+		assert.Nil(t, store.RefreshUser(first.Refr, refreshed), "Unexpected error refreshing: %s", name)
+
+		sessions, err := reg.ListSessions(email)
+		assert.Nil(t, err, "Unexpected error listing sessions: %s", name)
+		if assert.Equal(t, 2, len(sessions), "Refresh should not add a session: %s", name) {
+			assert.Equal(t, first.Refr.Session, sessions[0].ID, "Was expecting the oldest session first: %s", name)
+			assert.Equal(t, second.Refr.Session, sessions[1].ID, "Unexpected second session: %s", name)
+			assert.Equal(t, email, sessions[0].User, "Unexpected user on session: %s", name)
+			assert.WithinDuration(t, time.Now(), sessions[0].Created, 5*time.Second, "Unexpected time of login: %s", name)
+		}
+
+		assert.NotNil(t, reg.RevokeSession("someoneelse@gmail.com", first.Refr.Session), "Cannot revoke session of another user: %s", name)
+		assert.Nil(t, store.TokenStatus(refreshed.Auth), "Session of the user should not be revoked by another: %s", name)
+		assert.Nil(t, reg.RevokeSession(email, first.Refr.Session), "Unexpected error revoking session: %s", name)
+		assert.NotNil(t, store.TokenStatus(refreshed.Auth), "Tokens of the revoked session should be logged out: %s", name)
+		assert.NotNil(t, store.TokenStatus(refreshed.Refr), "Tokens of the revoked session should be logged out: %s", name)
+		assert.Nil(t, store.TokenStatus(second.Auth), "Other session should not be revoked: %s", name)
+		err = reg.RevokeSession(email, first.Refr.Session)
+		_, ok := err.(*ex.ErrNotFound)
+		assert.True(t, ok, "Unexpected error %v revoking session already revoked: %s", err, name)
+
+		third := &TokenPair{}
+		assert.Nil(t, store.LoginUser(email, 2, third), "Unexpected error logging in: %s", name)
+		assert.Nil(t, reg.RevokeAllSessions(email), "Unexpected error revoking all sessions: %s", name)
+		for _, tok := range []*JWTok{second.Auth, second.Refr, third.Auth, third.Refr} {
+			assert.NotNil(t, store.TokenStatus(tok), "All tokens of the user should be logged out: %s", name)
+		}
+		sessions, _ = reg.ListSessions(email)
+		assert.Empty(t, sessions, "Was expecting no sessions: %s", name)
+
+		// session ends with the logout of its last token
+		fourth := &TokenPair{}
+		assert.Nil(t, store.LoginUser(email, 2, fourth, LoginMeta(SessionMeta{IP: "10.0.0.4"})), "Unexpected error logging in: %s", name)
+		assert.Nil(t, store.LogoutToken(fourth.Auth), "Unexpected error logging out: %s", name)
+		sessions, _ = reg.ListSessions(email)
+		assert.Equal(t, 1, len(sessions), "Session should live on with its refr token: %s", name)
+		assert.Nil(t, store.LogoutToken(fourth.Refr), "Unexpected error logging out: %s", name)
+		sessions, _ = reg.ListSessions(email)
+		assert.Empty(t, sessions, "Session logged out should not be listed: %s", name)
+		_, err = reg.GetSession(email, fourth.Refr.Session)
+		_, ok = err.(*ex.ErrNotFound)
+		assert.True(t, ok, "Unexpected error %v getting session logged out: %s", err, name)
+	}
+}
+
+func TestSessionMeta(t *testing.T) {
+	for name, store := range testStores(t) {
+		reg := store.(SessionRegistry)
+		email := fmt.Sprintf("sessmeta%d@gmail.com", time.Now().UnixNano())
+		meta := SessionMeta{IP: "192.168.1.10", UserAgent: "Mozilla/5.0", Serial: "b8:27:eb:12:34:56", Method: "device"}
+		pair, refreshed := &TokenPair{}, &TokenPair{}
+		assert.Nil(t, store.LoginUser(email, 2, pair, LoginMeta(meta)), "Unexpected error logging in: %s", name)
+
+		sess, err := reg.GetSession(email, pair.Auth.Session)
+		if assert.Nil(t, err, "Unexpected error getting session: %s", name) {
+			assert.Equal(t, meta, sess.SessionMeta, "Unexpected metadata on session: %s", name)
+			assert.WithinDuration(t, time.Now(), sess.Created, 5*time.Second, "Unexpected time of login: %s", name)
+			assert.False(t, sess.LastSeen.Before(sess.Created), "Session should be seen at login: %s", name)
+		}
+
+		<-time.After(20 * time.Millisecond)
+		assert.Nil(t, store.TokenStatus(pair.Auth), "Unexpected error getting token status: %s", name)
+		seen, err := reg.GetSession(email, pair.Auth.Session)
+		if assert.Nil(t, err, "Unexpected error getting session: %s", name) {
+			assert.True(t, seen.LastSeen.After(sess.LastSeen), "TokenStatus should update last seen: %s", name)
+		}
+
+		// metadata is kept across the refresh
+		assert.Nil(t, store.RefreshUser(pair.Refr, refreshed), "Unexpected error refreshing: %s", name)
+		sessions, err := reg.ListSessions(email)
+		assert.Nil(t, err, "Unexpected error listing sessions: %s", name)
+		if assert.Equal(t, 1, len(sessions), "Was expecting one session: %s", name) {
+			assert.Equal(t, meta, sessions[0].SessionMeta, "Metadata should be kept across refresh: %s", name)
+			assert.False(t, sessions[0].LastSeen.Before(seen.LastSeen), "Unexpected last seen after refresh: %s", name)
+		}
+
+		assert.Nil(t, reg.RevokeSession(email, pair.Auth.Session), "Unexpected error revoking session: %s", name)
+		_, err = reg.GetSession(email, pair.Auth.Session)
+		_, ok := err.(*ex.ErrNotFound)
+		assert.True(t, ok, "Unexpected error %v getting revoked session: %s", err, name)
+	}
+}
+
+func TestSessionLimit(t *testing.T) {
+	policy := &TokenPolicy{
+		Limit:  SessionLimit{Max: 2, Policy: RejectNew},
+		Limits: map[int]SessionLimit{0: {Max: 1, Policy: EvictOldest}, 3: {Max: 1, Policy: RejectNew}, 9: {}},
+	}
+	for name, store := range testStores(t) {
+		evicted := []*TokEvent{}
+		switch s := store.(type) {
+		case *MemStore:
+			s.Policy, s.OnEvent = policy, func(ev *TokEvent) { evicted = append(evicted, ev) }
+		case *TokenCache:
+			s.Policy, s.OnEvent = policy, func(ev *TokEvent) { evicted = append(evicted, ev) }
+		}
+		reg := store.(SessionRegistry)
+		email := fmt.Sprintf("sesslimit%d@gmail.com", time.Now().UnixNano())
+
+		// over the limit the login is rejected, refreshes are not limited
+		first, second, refreshed := &TokenPair{}, &TokenPair{}, &TokenPair{}
+		assert.Nil(t, store.LoginUser(email, 2, first), "Unexpected error logging in: %s", name)
+		assert.Nil(t, store.LoginUser(email, 2, second), "Unexpected error logging in: %s", name)
+		err := store.LoginUser(email, 2, &TokenPair{})
+		_, ok := err.(*ex.ErrInsuffPrivlg)
+		assert.True(t, ok, "Unexpected error %v logging in over the limit: %s", err, name)
+		sessions, _ := reg.ListSessions(email)
+		assert.Equal(t, 2, len(sessions), "Rejected login should not start a session: %s", name)
+		assert.Nil(t, store.RefreshUser(first.Refr, refreshed), "Refresh should not be limited: %s", name)
+		assert.Nil(t, reg.RevokeSession(email, first.Auth.Session), "Unexpected error revoking session: %s", name)
+		assert.Nil(t, store.LoginUser(email, 2, &TokenPair{}), "Was expecting the login after a session is revoked: %s", name)
+		assert.Nil(t, reg.RevokeAllSessions(email), "Unexpected error revoking sessions: %s", name)
+
+		// over the limit the oldest session makes way
+		oldest, newest := &TokenPair{}, &TokenPair{}
+		assert.Nil(t, store.LoginUser(email, 0, oldest), "Unexpected error logging in: %s", name)
+		assert.Nil(t, store.LoginUser(email, 0, newest), "Unexpected error logging in: %s", name)
+		assert.NotNil(t, store.TokenStatus(oldest.Auth), "Evicted session should be logged out: %s", name)
+		assert.Nil(t, store.TokenStatus(newest.Auth), "Unexpected error getting token status: %s", name)
+		sessions, _ = reg.ListSessions(email)
+		if assert.Equal(t, 1, len(sessions), "Was expecting only the newest session: %s", name) {
+			assert.Equal(t, newest.Auth.Session, sessions[0].ID, "Unexpected session left: %s", name)
+		}
+		if assert.Equal(t, 1, len(evicted), "Was expecting an event for the eviction: %s", name) {
+			assert.Equal(t, EvtSessionEvicted, evicted[0].Kind, "Unexpected event: %s", name)
+			assert.Equal(t, oldest.Auth.Session, evicted[0].Session, "Unexpected session evicted: %s", name)
+		}
+		assert.Nil(t, reg.RevokeAllSessions(email), "Unexpected error revoking sessions: %s", name)
+
+		// session logged out does not count against the limit
+		seat := &TokenPair{}
+		assert.Nil(t, store.LoginUser(email, 3, seat), "Unexpected error logging in: %s", name)
+		assert.Nil(t, store.LogoutToken(seat.Auth), "Unexpected error logging out: %s", name)
+		assert.Nil(t, store.LogoutToken(seat.Refr), "Unexpected error logging out: %s", name)
+		assert.Nil(t, store.LoginUser(email, 3, seat), "Session logged out should free the seat: %s", name)
+		assert.Nil(t, reg.RevokeAllSessions(email), "Unexpected error revoking sessions: %s", name)
+
+		// role exempt from the limit
+		for i := 0; i < 3; i++ {
+			assert.Nil(t, store.LoginUser(email, 9, &TokenPair{}), "Exempt role should not be limited: %s", name)
+		}
+		assert.Nil(t, reg.RevokeAllSessions(email), "Unexpected error revoking sessions: %s", name)
+	}
+}
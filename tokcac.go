@@ -5,18 +5,46 @@ import (
 
 	ex "github.com/eensymachines-in/errx"
 	"github.com/go-redis/redis/v7"
+	"github.com/google/uuid"
 )
 
-var (
-	// AuthExp : duration for which the authentication token lives in the cache
+const (
+	// AuthExp : default duration for which the authentication token lives in the cache, see TokenPolicy
 	AuthExp = time.Duration(70 * time.Second)
-	// RefrExp : time duration for which the refresh token lives in the cache
+	// RefrExp : default duration for which the refresh token lives in the cache, see TokenPolicy
 	RefrExp = time.Duration(140 * time.Second)
 )
 
 // TokenCache : extension of the redis session
+// Client is any of the single node, failover (Sentinel) or cluster clients
 type TokenCache struct {
-	*redis.Client
+	Client   redis.UniversalClient
+	Issuer   string          // iss claim on all the tokens that are logged in
+	Audience []string        // aud claim on all the tokens that are logged in
+	Opaque   bool            // when set, logins issue opaque references and the claims stay in the cache
+	OnEvent  func(*TokEvent) // events for auditing, logged when not set
+	Policy   *TokenPolicy    // lifetimes of the tokens, AuthExp and RefrExp when not set
+	Verifier Verifier        // verifies the tokens for Verify, the RefVerifier when Opaque and not set
+	// RefSecret : HMAC key the slot of the user is masked with in the opaque references, same on all the instances
+	// when not set it is random to the process, references issued by one instance are then good on none other, nor after a restart
+	RefSecret []byte
+}
+
+const (
+	// sessPrefix : cache keys for the set of keys that belong to a login session
+	sessPrefix = "sess:"
+	// usedPrefix : cache keys that mark refr tokens already rotated
+	usedPrefix = "used:"
+)
+
+// sessKey : cache key for the set of keys in the session of the user, tokens and references
+func sessKey(email, sid string) string {
+	return sessPrefix + slotTag(email) + sid
+}
+
+// usedKey : cache key that marks the refr token of the user rotated
+func usedKey(email, uuid string) string {
+	return usedPrefix + slotTag(email) + uuid
 }
 
 // Close : closes the cache connection
@@ -34,43 +62,551 @@ func (tc *TokenCache) Ping() error {
 	return nil
 }
 
+// tokStatus : checks the token is in the cache and the session is alive, then marks the session seen
+// session is alive till the metadata is, the idle timeout is the ttl on it - extended here but never beyond the cap
+// KEYS[1] is the token, KEYS[2] the metadata of the session when the token has one - ARGV[1] the time now in unix milliseconds
+// returns 1 when the token is in the cache, else 0
+var tokStatus = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 0 then
+	return 0
+end
+if #KEYS > 1 then
+	if redis.call("EXISTS", KEYS[2]) == 0 then
+		return 0
+	end
+	local now = tonumber(ARGV[1])
+	local untl = tonumber(redis.call("HGET", KEYS[2], "until") or "0")
+	if untl > 0 and now >= untl then
+		return 0
+	end
+	redis.call("HSET", KEYS[2], "seen", ARGV[1])
+	local idle = tonumber(redis.call("HGET", KEYS[2], "idle") or "0")
+	if idle > 0 then
+		if untl > 0 and untl - now < idle then
+			idle = untl - now
+		end
+		redis.call("PEXPIRE", KEYS[2], idle)
+	end
+end
+return 1
+`)
+
 // TokenStatus : denotes the state of the tokens in the cache
+// session of the token is marked seen, and the idle timeout on it extended
+// ErrTokenExpired : token has expired or was logged out, or the session has idled out or reached the cap
 func (tc *TokenCache) TokenStatus(tok *JWTok) error {
-	_, err := tc.Client.Get(tok.UUID).Result()
+	keys := []string{tokKey(tok.User, tok.UUID)}
+	if tok.Session != "" {
+		keys = append(keys, metaKey(tok.User, tok.Session))
+	}
+	n, err := tokStatus.Run(tc.Client, keys, time.Now().UnixNano()/int64(time.Millisecond)).Int()
 	if err != nil {
-		if err == redis.Nil {
-			return ex.NewErr(&ex.ErrTokenExpired{}, err, "Failed to get auth status", "TokenCache.TokenStatus/tc.Client.Get()")
-		}
-		return ex.NewErr(&ex.ErrCacheQuery{}, err, "Failed to get auth status", "TokenCache.TokenStatus/tc.Client.Get()")
+		return ex.NewErr(&ex.ErrCacheQuery{}, err, "Failed to get auth status", "TokenCache.TokenStatus/tokStatus.Run()")
+	}
+	if n == 0 {
+		return ex.NewErr(&ex.ErrTokenExpired{}, nil, "Failed to get auth status", "TokenCache.TokenStatus/tokStatus.Run()")
 	}
 	return nil
 }
 
+// refreshAll : a refr token can be used only once, it is swapped for the new pair in one go
+// the new pair is set as setAll would, only then is the refr token removed and marked used
+// the marker has the time of the rotation and the keys of the new pair
+// refr token presented again within the grace is taken for a retry - the response with the new pair never reached the client
+// the pair issued before is removed and a new one set, the session lives on
+// presented again after the grace all the keys in the session are removed
+// KEYS[1] is the refr token, KEYS[2] the used marker, then the keys as for setAll - session set, index, metadata, entries
+// ARGV[1] is the ttl of the marker in milliseconds, ARGV[2] the time now in unix milliseconds, ARGV[3] the grace in milliseconds
+// then the args as for setAll
+// returns as setAll, {0} also when the refr token has expired or was logged out, or the session has idled out or reached the cap
+// {2, {jti, ttl pairs denied}} when reused and the session revoked, {3} in place of {1} when taken for a retry - a grace of 0 has no retries
+// keys of the pair issued before are read from the marker, and those of the session from its set - not in KEYS
+// like KEYS they are all under the slot tag of the user, the script stays in the one slot on a cluster
+var refreshAll = redis.NewScript(setAllLua + `
+local K, A = {}, {}
+for i = 3, #KEYS do
+	table.insert(K, KEYS[i])
+end
+for i = 4, #ARGV do
+	table.insert(A, ARGV[i])
+end
+local now = tonumber(ARGV[2])
+local retry = false
+if redis.call("EXISTS", KEYS[1]) == 0 then
+	if redis.call("EXISTS", KEYS[2]) == 0 then
+		return {0}
+	end
+	local grace = tonumber(ARGV[3])
+	if grace <= 0 or now - tonumber(redis.call("HGET", KEYS[2], "at") or "0") > grace then
+		return {2, revoke(K[1])}
+	end
+	retry = true
+end
+local untl = tonumber(redis.call("HGET", K[3], "until") or "0")
+if untl > 0 and now >= untl then
+	return {0}
+end
+local result = setAll(K, A)
+if result[1] ~= 1 then
+	return result
+end
+if retry then
+	for k in string.gmatch(redis.call("HGET", KEYS[2], "succ") or "", "%S+") do
+		redis.call("DEL", k)
+	end
+else
+	redis.call("DEL", KEYS[1])
+	redis.call("HSET", KEYS[2], "at", ARGV[2])
+end
+redis.call("HSET", KEYS[2], "succ", table.concat(K, " ", 4))
+redis.call("PEXPIRE", KEYS[2], ARGV[1])
+for _, k in ipairs(redis.call("SMEMBERS", K[1])) do
+	if redis.call("EXISTS", k) == 0 then
+		redis.call("SREM", K[1], k)
+	end
+end
+if retry then
+	result[1] = 3
+end
+return result
+`)
+
 // RefreshUser : rehydrates the authentication token in the cache
-// uses the refr token to generate a new pair of tokens
-func (tc *TokenCache) RefreshUser(refr *JWTok, result *TokenPair) error {
-	tc.LogoutToken(refr)
-	return tc.LoginUser(refr.User, refr.Role, result)
+// uses the refr token to generate a new pair of tokens, the refr token can be used only once
+// the new pair belongs to the same login session as the refr token, it is set and the refr token used up in one go
+// refr token presented again within the grace of the TokenPolicy gets a new pair in place of the one issued before
+// scopes : down-scopes the new auth token, when none the auth token has the same scopes as the refr token
+// the new refr token always keeps the scopes granted at login
+// TokErr : token is the auth token of a pair, ErrTokClaims
+// ErrInsuffPrivlg : scope asked for was never granted to the refr token
+// ErrTokenExpired : refr token has expired, was logged out or was already used, or the session has idled out or reached the cap
+// when already used after the grace, the whole session is revoked and EvtRefrReuse is emitted, within the grace EvtRefrRetry
+// ErrCacheQuery : cache could not be queried
+func (tc *TokenCache) RefreshUser(refr *JWTok, result *TokenPair, scopes ...string) error {
+	opts, err := refreshOpts(refr, scopes, "TokenCache.RefreshUser")
+	if err != nil {
+		return err
+	}
+	if refr.Session != "" {
+		// cap on the session is set once at login, the tokens of the new pair live no longer
+		untl, err := tc.Client.HGet(metaKey(refr.User, refr.Session), "until").Int64()
+		if err != nil && err != redis.Nil {
+			return ex.NewErr(&ex.ErrCacheQuery{}, err, "Failed to refresh user authentication", "TokenCache.RefreshUser/tc.Client.HGet()")
+		}
+		until := time.Time{}
+		if untl > 0 {
+			until = time.Unix(0, untl*int64(time.Millisecond))
+		}
+		opts = append(opts, loginSession(refr.Session, until))
+	}
+	conf := newLoginConf(opts)
+	lt := tc.Policy.lifetime(refr.Role, conf.client, conf.lifetime)
+	pair := conf.newPair(refr.User, refr.Role, tc.Issuer, tc.Audience, lt)
+	entries, err := tc.pairEntries(pair)
+	if err != nil {
+		return err
+	}
+	ttl := refr.Exp
+	if ttl < time.Millisecond {
+		ttl = time.Millisecond
+	}
+	keys, args := setAllArgs(refr.User, conf, conf.sessFields(lt), SessionLimit{}, entries)
+	keys = append([]string{tokKey(refr.User, refr.UUID), usedKey(refr.User, refr.UUID)}, keys...)
+	args = append([]interface{}{ttl.Milliseconds(), time.Now().UnixNano() / int64(time.Millisecond), tc.Policy.grace().Milliseconds()}, args...)
+	val, err := refreshAll.Run(tc.Client, keys, args...).Result()
+	if err != nil {
+		return ex.NewErr(&ex.ErrCacheQuery{}, err, "Failed to refresh user authentication", "TokenCache.RefreshUser/refreshAll.Run()")
+	}
+	res, _ := val.([]interface{})
+	if len(res) > 0 {
+		switch code, _ := res[0].(int64); code {
+		case 0:
+			return ex.NewErr(&ex.ErrTokenExpired{}, nil, "Login has expired, login again", "TokenCache.RefreshUser/refreshAll.Run()")
+		case 2:
+			tc.publishDenied(res, "TokenCache.RefreshUser")
+			emitEvent(tc.OnEvent, &TokEvent{Kind: EvtRefrReuse, User: refr.User, Session: refr.Session, UUID: refr.UUID})
+			return ex.NewErr(&ex.ErrTokenExpired{}, nil, "Login has been revoked, login again", "TokenCache.RefreshUser/refreshAll.Run()")
+		case 3:
+			emitEvent(tc.OnEvent, &TokEvent{Kind: EvtRefrRetry, User: refr.User, Session: refr.Session, UUID: refr.UUID})
+			res[0] = int64(1)
+		}
+	}
+	if _, err := setAllResult(res, "TokenCache.RefreshUser/refreshAll.Run()"); err != nil {
+		return err
+	}
+	*result = *pair
+	return nil
+}
+
+// refreshOpts : login options for the pair that replaces the refr token
+// TokErr : token is the auth token of a pair, it cannot refresh
+// ErrInsuffPrivlg : scope asked for was never granted to the refr token
+func refreshOpts(refr *JWTok, scopes []string, ctx string) ([]LoginOption, error) {
+	if refr.Use == UseAuth {
+		return nil, newTokErr(ErrTokClaims, nil, ctx)
+	}
+	if !refr.HasAllScopes(scopes...) {
+		return nil, ex.NewErr(&ex.ErrInsuffPrivlg{}, nil, "Cannot refresh with scopes that were never granted", ctx+"/refr.HasAllScopes()")
+	}
+	if len(scopes) == 0 {
+		scopes = refr.Scopes
+	}
+	return []LoginOption{LoginScopes(refr.Scopes...), authScopes(scopes...), LoginClient(refr.Client)}, nil
+}
+
+// LoginOption : optional settings for the login
+type LoginOption func(lc *loginConf)
+
+// loginConf : what the login is done with
+type loginConf struct {
+	scopes     []string
+	authScopes []string // when the auth token is down-scoped from the refr token
+	session    string   // sid of the login, new for every login and the same for the refreshes after
+	meta       *SessionMeta
+	client     string    // type of client the login is from
+	lifetime   Lifetime  // explicit lifetimes, over the policy
+	fresh      bool      // new session, the metadata and the timeouts of the session are recorded
+	until      time.Time // cap on the session recorded at login, tokens of the refreshes live no longer
+}
+
+// LoginScopes : scopes granted to the tokens of the login
+func LoginScopes(scopes ...string) LoginOption {
+	return func(lc *loginConf) {
+		lc.scopes = scopes
+	}
+}
+
+// authScopes : down-scopes only the auth token, the refr token keeps the scopes of the login
+func authScopes(scopes ...string) LoginOption {
+	return func(lc *loginConf) {
+		lc.authScopes = scopes
+	}
+}
+
+// loginSession : pair is issued in the session of the refr token it replaces
+// until : cap on the session, zero when none
+func loginSession(sid string, until time.Time) LoginOption {
+	return func(lc *loginConf) {
+		lc.session = sid
+		lc.until = until
+	}
+}
+
+func newLoginConf(opts []LoginOption) *loginConf {
+	result := &loginConf{}
+	for _, opt := range opts {
+		opt(result)
+	}
+	if result.authScopes == nil {
+		result.authScopes = result.scopes
+	}
+	if result.session == "" {
+		result.session = uuid.New().String()
+		result.fresh = true
+	}
+	return result
+}
+
+// newPair : token pair for the login, living as long as the lifetime has it but never beyond the cap on the session
+func (lc *loginConf) newPair(email string, role int, iss string, aud []string, lt Lifetime) *TokenPair {
+	if !lc.until.IsZero() {
+		lt = lt.capped(time.Until(lc.until))
+	}
+	return &TokenPair{
+		Auth: NewToken(email, role, lt.Auth, WithIssuer(iss), WithAudience(aud...), WithScopes(lc.authScopes...), WithSession(lc.session), WithClient(lc.client), WithUse(UseAuth)),
+		Refr: NewToken(email, role, lt.Refr, WithIssuer(iss), WithAudience(aud...), WithScopes(lc.scopes...), WithSession(lc.session), WithClient(lc.client), WithUse(UseRefr)),
+	}
+}
+
+// sessLimit : limit on the sessions of the user for the login, refreshes are never limited
+func (lc *loginConf) sessLimit(tp *TokenPolicy, role int) SessionLimit {
+	if !lc.fresh {
+		return SessionLimit{}
+	}
+	return tp.limit(role)
+}
+
+// sessFields : field value pairs of the session metadata recorded at login, none for the refreshes after
+// idle timeout in milliseconds, cap on the session in unix milliseconds
+func (lc *loginConf) sessFields(lt Lifetime) []interface{} {
+	if !lc.fresh {
+		return nil
+	}
+	result := []interface{}{}
+	if lc.meta != nil {
+		result = append(result, lc.meta.fields()...)
+	}
+	if lt.Idle > 0 {
+		result = append(result, "idle", lt.Idle.Milliseconds())
+	}
+	if lt.Max > 0 {
+		result = append(result, "until", time.Now().Add(lt.Max).UnixNano()/int64(time.Millisecond))
+	}
+	return result
+}
+
+// cacheEntry : key to be set in the cache, with the value and the ttl
+type cacheEntry struct {
+	key string
+	val interface{}
+	ttl time.Duration
+}
+
+// revokeLua : removes the session set and all the keys in it, the tokens are put on the denylist for the rest of their life
+// S is the session set, token keys in it are the ones that start with the slot tag - the denylist key is the token key with denyPrefix
+// returns the jti, ttl in milliseconds pairs of the tokens denied, for them to be published
+const revokeLua = `
+local function revoke(S)
+	local denied = {}
+	for _, k in ipairs(redis.call("SMEMBERS", S)) do
+		if string.sub(k, 1, 1) == "{" then
+			local ttl = redis.call("PTTL", k)
+			if ttl > 0 then
+				redis.call("SET", "` + denyPrefix + `" .. k, "1", "PX", ttl)
+				table.insert(denied, string.sub(k, string.find(k, "}", 1, true) + 1))
+				table.insert(denied, ttl)
+			end
+		end
+		redis.call("DEL", k)
+	end
+	redis.call("DEL", S)
+	return denied
+end
+`
+
+// setAllLua : sets all the keys or none, none when any of the keys is already set
+// K[1] is the session set, the rest of the keys are added to it so that the session can be revoked as a whole
+// K[2] is the index of the sessions of the user, the session is added to it by the time of login
+// K[3] is the hash of metadata of the session, last seen is set to the time of login
+// A[1] is the ttl of the session in milliseconds, A[2] the sid, A[3] the time of login in unix milliseconds
+// A[4] the count of metadata fields, A[5] the limit on sessions of the user - 0 for none, A[6] 1 to evict over the limit
+// A[7] the prefix of session keys, A[8] the prefix of metadata keys, A[9] 1 when the session is new
+// then the field value pairs of the metadata, then the value and the ttl for each of the keys in order
+// session that is not new has to have its metadata, else it was revoked or has expired - nothing is set
+// when the user has as many live sessions as the limit the login is rejected, or the oldest sessions are revoked
+// the tokens of the sessions evicted are put on the denylist
+// returns {1, sids evicted .., {jti, ttl pairs denied}} when set, {0} when a key was already set or the session is gone, {-1} when rejected over the limit
+// the session and the index never have their ttl shortened, they live as long as the longest lived key in them
+// so does the metadata, unless the session has an idle timeout - then that is the ttl
+// either way the metadata does not outlive the cap on the session
+// sessions evicted are by the sids in the index and the keys read from their session sets, neither are in KEYS
+// they carry the slot tag of the user as all the KEYS do, so on a cluster the script stays in the one slot
+const setAllLua = revokeLua + `
+local function setAll(K, A)
+	local off = 9 + 2 * tonumber(A[4])
+	for i = 4, #K do
+		if redis.call("EXISTS", K[i]) == 1 then
+			return {0}
+		end
+	end
+	if A[9] ~= "1" and redis.call("EXISTS", K[3]) == 0 then
+		return {0}
+	end
+	local result = {1}
+	local denied = {}
+	local max = tonumber(A[5])
+	if max > 0 then
+		local live = {}
+		for _, sid in ipairs(redis.call("ZRANGE", K[2], 0, -1)) do
+			if redis.call("EXISTS", A[7] .. sid) == 1 and redis.call("EXISTS", A[8] .. sid) == 1 then
+				table.insert(live, sid)
+			else
+				redis.call("ZREM", K[2], sid)
+			end
+		end
+		if #live >= max then
+			if A[6] ~= "1" then
+				return {-1}
+			end
+			for i = 1, #live - max + 1 do
+				for _, x in ipairs(revoke(A[7] .. live[i])) do
+					table.insert(denied, x)
+				end
+				redis.call("ZREM", K[2], live[i])
+				table.insert(result, live[i])
+			end
+		end
+	end
+	for i = 4, #K do
+		local j = off + 2 * (i - 4)
+		redis.call("SET", K[i], A[j+1], "PX", A[j+2])
+		redis.call("SADD", K[1], K[i])
+	end
+	redis.call("ZADD", K[2], "NX", A[3], A[2])
+	for i = 10, off, 2 do
+		redis.call("HSET", K[3], A[i], A[i+1])
+	end
+	redis.call("HSET", K[3], "seen", A[3])
+	redis.call("SADD", K[1], K[3])
+	for i = 1, 2 do
+		if redis.call("PTTL", K[i]) < tonumber(A[1]) then
+			redis.call("PEXPIRE", K[i], A[1])
+		end
+	end
+	local ttl = tonumber(A[1])
+	local idle = tonumber(redis.call("HGET", K[3], "idle") or "0")
+	if idle > 0 then
+		ttl = idle
+	elseif redis.call("PTTL", K[3]) > ttl then
+		ttl = redis.call("PTTL", K[3])
+	end
+	local untl = tonumber(redis.call("HGET", K[3], "until") or "0")
+	if untl > 0 and untl - tonumber(A[3]) < ttl then
+		ttl = untl - tonumber(A[3])
+	end
+	redis.call("PEXPIRE", K[3], ttl)
+	table.insert(result, denied)
+	return result
+end
+`
+
+// setAllNX : setAllLua on the KEYS and ARGV
+var setAllNX = redis.NewScript(setAllLua + `
+return setAll(KEYS, ARGV)
+`)
+
+// setAllArgs : keys and args for setAllLua, entries are set in the session of the login
+// fields : field value pairs of the session metadata, none when the session already has it
+// limit : limit on the sessions of the user, zero for none - refreshes are never limited
+func setAllArgs(email string, conf *loginConf, fields []interface{}, limit SessionLimit, entries []cacheEntry) ([]string, []interface{}) {
+	keys := []string{sessKey(email, conf.session), userKey(email), metaKey(email, conf.session)}
+	evict, fresh := 0, 0
+	if limit.Policy == EvictOldest {
+		evict = 1
+	}
+	if conf.fresh {
+		fresh = 1
+	}
+	args := []interface{}{int64(0), conf.session, time.Now().UnixNano() / int64(time.Millisecond), len(fields) / 2, limit.Max, evict, sessPrefix + slotTag(email), metaPrefix + slotTag(email), fresh}
+	args = append(args, fields...)
+	for _, e := range entries {
+		keys = append(keys, e.key)
+		args = append(args, e.val, e.ttl.Milliseconds())
+		if e.ttl.Milliseconds() > args[0].(int64) {
+			args[0] = e.ttl.Milliseconds()
+		}
+	}
+	return keys, args
+}
+
+// setAllResult : sids of the sessions evicted, from the result of setAllLua
+// ErrInsuffPrivlg : user already has as many sessions as the limit, and the limit rejects new logins
+// ErrCacheQuery : one of the keys was already set, or the session is gone
+func setAllResult(res []interface{}, ctx string) ([]string, error) {
+	code := int64(0)
+	if len(res) > 0 {
+		code, _ = res[0].(int64)
+	}
+	switch code {
+	case 1:
+	case -1:
+		return nil, ex.NewErr(&ex.ErrInsuffPrivlg{}, nil, "Too many sessions, logout from one of the other devices and try again", ctx)
+	default:
+		return nil, ex.NewErr(&ex.ErrCacheQuery{}, nil, "Failed to login user", ctx)
+	}
+	evicted := []string{}
+	for _, v := range res[1:] {
+		if s, ok := v.(string); ok {
+			evicted = append(evicted, s)
+		}
+	}
+	return evicted, nil
+}
+
+// setAll : sets all the entries in the cache atomically and adds them to the session of the login
+// either all of them are set or none
+// fields : field value pairs of the session metadata, none when the session already has it
+// limit : limit on the sessions of the user, zero for none - refreshes are never limited
+// returns the sids of the sessions evicted to make way for the login, their tokens are denied and published
+// ErrInsuffPrivlg : user already has as many sessions as the limit, and the limit rejects new logins
+// ErrCacheQuery : cache could not be queried, one of the keys was already set, or the session is not new and is gone
+func (tc *TokenCache) setAll(email string, conf *loginConf, fields []interface{}, limit SessionLimit, entries []cacheEntry, ctx string) ([]string, error) {
+	keys, args := setAllArgs(email, conf, fields, limit, entries)
+	val, err := setAllNX.Run(tc.Client, keys, args...).Result()
+	if err != nil {
+		return nil, ex.NewErr(&ex.ErrCacheQuery{}, err, "Failed to login user", ctx)
+	}
+	res, _ := val.([]interface{})
+	evicted, err := setAllResult(res, ctx)
+	if err != nil {
+		return nil, err
+	}
+	tc.publishDenied(res, ctx)
+	return evicted, nil
+}
+
+// pairEntries : cache entries for the tokens of the pair, and the claims under the references when opaque
+func (tc *TokenCache) pairEntries(pair *TokenPair) ([]cacheEntry, error) {
+	email := pair.Refr.User
+	entries := []cacheEntry{
+		{key: tokKey(email, pair.Auth.UUID), val: pair.Refr.UUID, ttl: pair.Auth.Exp},
+		{key: tokKey(email, pair.Refr.UUID), val: pair.Refr.User, ttl: pair.Refr.Exp},
+	}
+	if tc.Opaque {
+		for _, tok := range []*JWTok{pair.Auth, pair.Refr} {
+			// claims outlive the auth token, Verify can then tell if the login is on
+			e, err := tc.newRefEntry(tok, pair.Refr.Exp)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, *e)
+		}
+	}
+	return entries, nil
 }
 
 // LoginUser : this shall create 2 tokens and load them up in the cache
 // the way we load them in the cache is peculiar
-func (tc *TokenCache) LoginUser(email string, role int, result *TokenPair) error {
-	pair := &TokenPair{Auth: NewToken(email, role, AuthExp), Refr: NewToken(email, role, RefrExp)}
-	_, err := tc.Client.SetNX(pair.Auth.UUID, pair.Refr.UUID, AuthExp).Result()
+// both the tokens are loaded or neither is
+// opts : scopes granted to the login, metadata of the session, type of client and lifetimes
+// the TokenPolicy can limit the sessions of the user, sessions evicted for the login emit EvtSessionEvicted
+// ErrInsuffPrivlg : user already has as many sessions as the limit, and the limit rejects new logins
+// ErrCacheQuery : cache could not be queried, nothing of the login is in the cache
+func (tc *TokenCache) LoginUser(email string, role int, result *TokenPair, opts ...LoginOption) error {
+	conf := newLoginConf(opts)
+	lt := tc.Policy.lifetime(role, conf.client, conf.lifetime)
+	pair := conf.newPair(email, role, tc.Issuer, tc.Audience, lt)
+	entries, err := tc.pairEntries(pair)
 	if err != nil {
-		ex.NewErr(ex.ErrCacheQuery{}, err, "Failed to refresh user authentication", "TokenCache.RefreshUser/tc.Client.SetNX()")
+		return err
 	}
-	_, err = tc.Client.SetNX(pair.Refr.UUID, pair.Refr.User, RefrExp).Result()
+	evicted, err := tc.setAll(email, conf, conf.sessFields(lt), conf.sessLimit(tc.Policy, role), entries, "TokenCache.LoginUser/tc.setAll()")
 	if err != nil {
-		ex.NewErr(ex.ErrCacheQuery{}, err, "Failed to refresh user authentication", "TokenCache.RefreshUser/tc.Client.SetNX()")
+		return err
+	}
+	for _, sid := range evicted {
+		emitEvent(tc.OnEvent, &TokEvent{Kind: EvtSessionEvicted, User: email, Session: sid})
 	}
 	*result = *pair
 	return nil
 }
 
-// LogoutToken : removes the IDs from the cache permanently
+// LogoutToken : removes the IDs from the cache permanently, the token is known by the user and the UUID
+// for opaque tokens the claims under the reference are removed too
+// the jti is on the denylist for the rest of the token life, and is published to the Denylist subscribers
+// when it was the last token of its session, the session ends - it is no longer listed nor counted against the limit
+// ErrCacheQuery : cache could not be queried
 func (tc *TokenCache) LogoutToken(tok *JWTok) error {
-	_, err := tc.Client.Del(tok.UUID).Result()
-	return err
+	keys := []string{tokKey(tok.User, tok.UUID)}
+	if tok.Ref != "" {
+		keys = append(keys, tc.refKey(tok.Ref))
+	}
+	pipe := tc.Client.TxPipeline()
+	pipe.Del(keys...)
+	if tok.Session != "" {
+		endSession.Eval(pipe, []string{sessKey(tok.User, tok.Session), userKey(tok.User), metaKey(tok.User, tok.Session)}, tok.Session, refPrefix)
+	}
+	if tok.Exp > 0 {
+		pipe.Set(denyKey(tok.User, tok.UUID), "1", tok.Exp)
+	}
+	if _, err := pipe.Exec(); err != nil {
+		return ex.NewErr(&ex.ErrCacheQuery{}, err, "Failed to logout", "TokenCache.LogoutToken/pipe.Exec()")
+	}
+	if tok.Exp > 0 {
+		// channel hashes to a slot of its own, it cannot be in the transaction on a cluster
+		if err := tc.Client.Publish(DenyChannel, denyMsg(tok.UUID, time.Now().Add(tok.Exp))).Err(); err != nil {
+			return ex.NewErr(&ex.ErrCacheQuery{}, err, "Failed to logout", "TokenCache.LogoutToken/tc.Client.Publish()")
+		}
+	}
+	return nil
 }
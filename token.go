@@ -10,6 +10,8 @@ This deals with basic token operations
 */
 
 import (
+	"errors"
+	"net/http"
 	"time"
 
 	"github.com/dgrijalva/jwt-go"
@@ -28,6 +30,89 @@ import (
 // ErrExpiredTok : error specific to the expiry of the token
 type ErrExpiredTok error
 
+var (
+	// ErrTokMalformed : token string cannot be read as a token
+	ErrTokMalformed = errors.New("token is malformed")
+	// ErrTokSignature : token signature does not verify, or there isnt a key to verify it
+	ErrTokSignature = errors.New("token signature is invalid")
+	// ErrTokAlgorithm : token is signed with an algorithm that isnt allowed
+	ErrTokAlgorithm = errors.New("token signing algorithm is not allowed")
+	// ErrTokNotYetValid : token nbf / iat is in the future
+	ErrTokNotYetValid = errors.New("token is not valid yet")
+	// ErrTokExpired : token exp is in the past
+	ErrTokExpired = errors.New("token has expired")
+	// ErrTokClaims : token was issued elsewhere or meant for some other service
+	ErrTokClaims = errors.New("token claims are invalid")
+	// ErrTokRevoked : token was logged out before it expired, and is on the denylist
+	ErrTokRevoked = errors.New("token has been revoked")
+)
+
+// tokErrMsgs : user messages for each of the token errors
+var tokErrMsgs = map[error]string{
+	ErrTokMalformed:   "Failed to read authorization, please sign again",
+	ErrTokSignature:   "Authentication is invalid, please sign again",
+	ErrTokAlgorithm:   "Authentication is invalid, please sign again",
+	ErrTokNotYetValid: "Authentication is not valid yet",
+	ErrTokExpired:     "Authentication expired, please sign again",
+	ErrTokClaims:      "Authentication is not meant for this service, please sign again",
+	ErrTokRevoked:     "Authentication was revoked, please sign again",
+}
+
+// TokErr : error when the token fails to parse or validate
+// is an errx error so the api can digest it, and unwraps to one of the ErrTok.. errors above
+//
+//	if errors.Is(err, ErrTokExpired) { ... }
+type TokErr struct {
+	ex.Errx
+	kind error
+}
+
+// Unwrap : the ErrTok.. error that tells what went wrong with the token
+func (te *TokErr) Unwrap() error {
+	return te.kind
+}
+
+// HTTPStatusCode : malformed tokens are bad requests, while the rest are unauthorized
+func (te *TokErr) HTTPStatusCode() int {
+	if te.kind == ErrTokMalformed {
+		return http.StatusBadRequest
+	}
+	return http.StatusUnauthorized
+}
+
+// newTokErr : kind is one of the ErrTok.. errors, inner is the error from the underlying library
+func newTokErr(kind, inner error, ctx string) *TokErr {
+	if kind == ErrTokMalformed {
+		return &TokErr{Errx: ex.NewErr(&ex.ErrInvalid{}, inner, tokErrMsgs[kind], ctx), kind: kind}
+	}
+	return &TokErr{Errx: ex.NewErr(&ex.ErrTokenExpired{}, inner, tokErrMsgs[kind], ctx), kind: kind}
+}
+
+// parseErr : makes sense of the error from jwt.Parse
+func parseErr(err error) error {
+	ve, ok := err.(*jwt.ValidationError)
+	if !ok {
+		return newTokErr(ErrTokMalformed, err, "TokenStr.ParseWith/jwt.Parse()")
+	}
+	var te *TokErr
+	if errors.As(ve.Inner, &te) {
+		// error from the verifier
+		return te
+	}
+	if xe, ok := ve.Inner.(ex.Errx); ok {
+		// verifier could not get to the keys - key server or cache is down, not a bad token
+		return xe
+	}
+	switch {
+	case ve.Errors&jwt.ValidationErrorMalformed != 0:
+		return newTokErr(ErrTokMalformed, err, "TokenStr.ParseWith/jwt.Parse()")
+	case ve.Errors&jwt.ValidationErrorUnverifiable != 0:
+		// alg on the token header that isnt even registered
+		return newTokErr(ErrTokAlgorithm, err, "TokenStr.ParseWith/jwt.Parse()")
+	}
+	return newTokErr(ErrTokSignature, err, "TokenStr.ParseWith/jwt.Parse()")
+}
+
 // ++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
 
 // ++++++++++++++++++++++++++++++++++ Custom token, wrapper over *jwt.Token +++++++++++++++++++++++++++++++++
@@ -39,20 +124,41 @@ type JWTok struct {
 	Role int // this role determines to what parts of the application does a user have access to
 	UUID string
 	Exp  time.Duration // seconds in which the token expires, can be used in cache directly
+	// registered claims, sub and jti are the same as User and UUID
+	Issuer    string                 // iss - AuthAPI that issued the token
+	Audience  []string               // aud - services the token is meant for
+	IssuedAt  time.Time              // iat
+	NotBefore time.Time              // nbf
+	Custom    map[string]interface{} // claims specific to the services - tenant, device serial, display name
+	Scopes    []string               // what the token is allowed to do, finer than the role
+	Ref       string                 // opaque reference the token goes by, empty for self-contained tokens
+	Session   string                 // sid - login session, same on all the tokens rotated from one login
+	Client    string                 // client_type - type of client the login is from, picks the lifetime of the tokens
+	Use       string                 // token_use - UseAuth or UseRefr on the tokens of a pair, empty on the others
 }
 
 // ToString : this can convert the JWT token to a signed string
-// please also provid the secret as well
+// please also provid the secret as well, signs HS256
 func (jt *JWTok) ToString(secret string) (TokenStr, error) {
-	// Sign and get the complete encoded token as a string using the secret
-	str, err := jt.Token.SignedString([]byte(secret))
+	return jt.SignWith(NewHMACSigner(secret))
+}
+
+// SignWith : converts the JWT token to a string signed by the signer
+// use this when signing with the private key (RS256, ES256, EdDSA)
+// opaque tokens are never signed, it is the reference that goes out
+func (jt *JWTok) SignWith(s Signer) (TokenStr, error) {
+	if jt.Ref != "" {
+		return TokenStr(jt.Ref), nil
+	}
+	str, err := s.Sign(jt.Token)
 	if err != nil {
-		return TokenStr(""), ex.NewErr(ex.ErrInvalid{}, err, "Failed to get authentication token", "JWTok.ToString()")
+		return TokenStr(""), ex.NewErr(&ex.ErrInvalid{}, err, "Failed to get authentication token", "JWTok.SignWith()")
 	}
 	return TokenStr(str), nil
 }
 
 // HasElevation : checks to see if the token has sufficient elevation against the role expected
+// for anything finer than the role, see HasScope
 func (jt *JWTok) HasElevation(elev int) bool {
 	return jt.Role >= elev
 }
@@ -64,21 +170,22 @@ func (jt *JWTok) HasElevation(elev int) bool {
 // NewToken : constructs a new token ready to be pushed to cache
 // https://godoc.org/github.com/dgrijalva/jwt-go#example-New--Hmac
 // dur : expiry delta duration for the token
-func NewToken(user string, role int, dur time.Duration) *JWTok {
-	uu := uuid.New().String()
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"user": user,
-		"role": role,
-		"uuid": uu,
-		"exp":  time.Now().Add(dur).Unix(), //note this is the time AT which the token expires as unix seconds
-	})
-	return &JWTok{
-		Token: token,
-		User:  user,
-		Role:  role,
-		UUID:  uu,
-		Exp:   dur,
+// opts : optional claims, issuer, audience, scopes and custom claims
+func NewToken(user string, role int, dur time.Duration, opts ...TokOption) *JWTok {
+	now := time.Now()
+	result := &JWTok{
+		User:      user,
+		Role:      role,
+		UUID:      uuid.New().String(),
+		Exp:       dur,
+		IssuedAt:  now,
+		NotBefore: now,
 	}
+	for _, opt := range opts {
+		opt(result)
+	}
+	result.Token = jwt.NewWithClaims(jwt.SigningMethodHS256, result.mapClaims())
+	return result
 }
 
 // ++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
@@ -89,31 +196,76 @@ func NewToken(user string, role int, dur time.Duration) *JWTok {
 type TokenStr string
 
 // Parse : from the string token representation this converts to a JWTok
-func (ts TokenStr) Parse(secret string) (*JWTok, error) {
-	tok, err := jwt.Parse(string(ts), func(token *jwt.Token) (interface{}, error) {
-		// Don't forget to validate the alg is what you expect:
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			// return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
-			return nil, ex.NewErr(&ex.ErrInvalid{}, nil, "Failed to read authorization, please contact an admin", "TokenStr.Parse/token.Method.()")
+// token is expected to be signed HS256 with the secret
+func (ts TokenStr) Parse(secret string, opts ...ParseOption) (*JWTok, error) {
+	return ts.ParseWith(NewHMACVerifier(secret), opts...)
+}
+
+// tokenVerifier : verifiers that wrap other verifiers, and would want to verify the token on their own
+type tokenVerifier interface {
+	verifyToken(ts TokenStr) (*jwt.Token, error)
+}
+
+// verifyToken : verifies the token signature, claims are yet to be validated
+func verifyToken(ts TokenStr, v Verifier) (*jwt.Token, error) {
+	if tv, ok := v.(tokenVerifier); ok {
+		return tv.verifyToken(ts)
+	}
+	if cv, ok := v.(ClaimsVerifier); ok {
+		claims, err := cv.VerifyClaims(ts)
+		if err != nil {
+			return nil, err
 		}
-		// hmacSampleSecret is a []byte containing your secret, e.g. []byte("my_secret_key")
-		return []byte(secret), nil
-	})
+		return &jwt.Token{Raw: string(ts), Header: map[string]interface{}{}, Claims: claims, Valid: true}, nil
+	}
+	// registered claims are validated after, jwt-go cannot allow for leeway
+	tok, err := (&jwt.Parser{SkipClaimsValidation: true}).Parse(string(ts), v.VerifyKey)
 	if err != nil {
-		// return nil, ex.NewErr(ex.ErrTokenExpired{}, err, "Authentication expired, please sign again", "TokenStr.Parse/jwt.Parse()")
-		return nil, ex.NewErr(&ex.ErrTokenExpired{}, err, "Authentication expired, please sign again", "TokenStr.Parse/tok.Valid")
+		return nil, parseErr(err)
+	}
+	return tok, nil
+}
+
+// ParseWith : from the string token representation this converts to a JWTok
+// the verifier provides the key and validates the algorithm the token was signed with
+// opts : expected issuer, audience and the leeway for clock skew
+// TokErr : when the token fails, unwraps to ErrTokMalformed, ErrTokSignature, ErrTokAlgorithm, ErrTokNotYetValid, ErrTokExpired, ErrTokClaims
+// or ErrTokRevoked when verified with Denying
+// ErrTokClaims is also when the claims on the token are missing or of unexpected types
+func (ts TokenStr) ParseWith(v Verifier, opts ...ParseOption) (*JWTok, error) {
+	conf := newParseConf(opts)
+	tok, err := verifyToken(ts, v)
+	if err != nil {
+		return nil, err
 	}
 	// parse the claims and then send back the custom token
 	if claims, ok := tok.Claims.(jwt.MapClaims); ok && tok.Valid {
+		tc, err := decodeClaims(claims)
+		if err != nil {
+			return nil, err
+		}
+		if err := conf.validate(tc); err != nil {
+			return nil, err
+		}
 		return &JWTok{
-			Token: tok,
-			User:  claims["user"].(string),
-			Role:  int(claims["role"].(float64)), // here when inside the claims its always stored as float64
-			UUID:  claims["uuid"].(string),
+			Token:     tok,
+			User:      tc.User,
+			Role:      tc.Role,
+			UUID:      tc.UUID,
+			Exp:       time.Until(tc.ExpiresAt), // whats left of the token life
+			Issuer:    tc.Issuer,
+			Audience:  tc.Audience,
+			IssuedAt:  tc.IssuedAt,
+			NotBefore: tc.NotBefore,
+			Custom:    tc.Custom,
+			Scopes:    tc.Scopes,
+			Session:   tc.Session,
+			Client:    tc.Client,
+			Use:       tc.Use,
 		}, nil
 	}
 	// NOTE : if the token has expired the function shoudl fail at Parse itself, this is redundant but we will keep it
-	return nil, ex.NewErr(&ex.ErrTokenExpired{}, err, "Authentication expired, please sign again", "TokenStr.Parse/tok.Valid")
+	return nil, newTokErr(ErrTokMalformed, err, "TokenStr.ParseWith/tok.Valid")
 }
 
 // ++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
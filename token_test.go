@@ -0,0 +1,51 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	ex "github.com/eensymachines-in/errx"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenErrors(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	valid, _ := NewToken("kneeru@gmail.com", 2, AuthExp, WithIssuer("autolumin")).ToString("secretstring")
+	expired, _ := NewToken("kneeru@gmail.com", 2, -1*time.Minute).ToString("secretstring")
+	later, _ := NewToken("kneeru@gmail.com", 2, AuthExp, func(jt *JWTok) {
+		jt.NotBefore = time.Now().Add(1 * time.Minute)
+	}).ToString("secretstring")
+	unsigned, _ := jwt.NewWithClaims(jwt.SigningMethodNone, NewToken("kneeru@gmail.com", 2, AuthExp).mapClaims()).SignedString(jwt.UnsafeAllowNoneSignatureType)
+	data := []struct {
+		desc   string
+		tokStr TokenStr
+		v      Verifier
+		opts   []ParseOption
+		kind   error
+		status int
+	}{
+		{"garbage", TokenStr("notatoken"), NewHMACVerifier("secretstring"), nil, ErrTokMalformed, http.StatusBadRequest},
+		{"tampered", valid + "x", NewHMACVerifier("secretstring"), nil, ErrTokSignature, http.StatusUnauthorized},
+		{"wrong secret", valid, NewHMACVerifier("wrongkey"), nil, ErrTokSignature, http.StatusUnauthorized},
+		{"HMAC for RSA", valid, NewRSAVerifier(&rsaKey.PublicKey), nil, ErrTokAlgorithm, http.StatusUnauthorized},
+		{"alg none", TokenStr(unsigned), NewHMACVerifier("secretstring"), nil, ErrTokAlgorithm, http.StatusUnauthorized},
+		{"not yet valid", later, NewHMACVerifier("secretstring"), nil, ErrTokNotYetValid, http.StatusUnauthorized},
+		{"expired", expired, NewHMACVerifier("secretstring"), nil, ErrTokExpired, http.StatusUnauthorized},
+		{"other issuer", valid, NewHMACVerifier("secretstring"), []ParseOption{ExpectIssuer("aquaminder")}, ErrTokClaims, http.StatusUnauthorized},
+	}
+	for _, d := range data {
+		tok, err := d.tokStr.ParseWith(d.v, d.opts...)
+		assert.Nil(t, tok, "Was expecting token to be nil: %s", d.desc)
+		assert.True(t, errors.Is(err, d.kind), "Unexpected error %v: %s", err, d.desc)
+		x, ok := err.(ex.Errx)
+		assert.True(t, ok, "Was expecting errx error: %s", d.desc)
+		if ok {
+			assert.Equal(t, d.status, x.HTTPStatusCode(), "Unexpected http status: %s", d.desc)
+		}
+	}
+}
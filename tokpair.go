@@ -16,3 +16,14 @@ func (tp *TokenPair) MakeMarshalable(authSecret, refrSecret string) interface{}
 	result["refr"] = string(toks)
 	return result
 }
+
+// MarshalableWith : same as MakeMarshalable, but the tokens are signed with the signers
+// auth and refr can be signed differently, refr tokens encrypted while the auth tokens are not for instance
+func (tp *TokenPair) MarshalableWith(authSigner, refrSigner Signer) interface{} {
+	result := map[string]string{}
+	toks, _ := tp.Auth.SignWith(authSigner)
+	result["auth"] = string(toks)
+	toks, _ = tp.Refr.SignWith(refrSigner)
+	result["refr"] = string(toks)
+	return result
+}
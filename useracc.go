@@ -196,10 +196,10 @@ func (ua *UserAccounts) UpdateAccPasswd(newUser *UserAcc) error {
 
 // Authenticate : takes the requesting useracc creds and then compares that with the database to emit if the passwords match
 func (ua *UserAccounts) Authenticate(u *UserAcc) (bool, error) {
-	log.Debugf("Authenticate: Now authenticating the user account %s", u.Email)
 	if u == nil || u.Email == "" || u.Passwd == "" {
 		return false, ex.NewErr(&ex.ErrInvalid{}, nil, "Account to be authenticated cannot have empty emal/password", "UserAccounts.Authenticate")
 	}
+	log.Debugf("Authenticate: Now authenticating the user account %s", u.Email)
 	if !ua.IsRegistered(u.Email) {
 		return false, ex.NewErr(&ex.ErrNotFound{}, nil, "Unregistered accounts cannot be authenticated", "UserAccounts.Authenticate/ua.IsRegistered()")
 	}
@@ -214,6 +214,44 @@ func (ua *UserAccounts) Authenticate(u *UserAcc) (bool, error) {
 	return true, nil
 }
 
+// AuthenticateFrom : Authenticate, with the attempts limited by the email and the IP of the client
+// mismatching passwords (ErrLogin) are counted against the email and the IP, any other failed attempt against the IP
+// a successful one forgets the failures of the email, attempts that fail on the database (ErrQuery) are not counted
+// ErrLoginLimited : attempt is held off, or the account / IP is locked out
+// ErrCacheQuery : limiter could not query the cache
+func (ua *UserAccounts) AuthenticateFrom(u *UserAcc, ip string, lim *LoginLimiter) (bool, error) {
+	return authLimited(ua.Authenticate, u, ip, lim)
+}
+
+// authLimited : authenticates with the attempt reserved on the limiter, and then settled by the outcome
+func authLimited(authenticate func(u *UserAcc) (bool, error), u *UserAcc, ip string, lim *LoginLimiter) (bool, error) {
+	if u == nil {
+		return false, ex.NewErr(&ex.ErrInvalid{}, nil, "Account to be authenticated cannot be nil", "authLimited")
+	}
+	if err := lim.Allow(u.Email, ip); err != nil {
+		return false, err
+	}
+	ok, err := authenticate(u)
+	var settle error
+	switch err.(type) {
+	case nil:
+		settle = lim.Succeed(u.Email)
+	case *ex.ErrLogin:
+		settle = lim.Fail(u.Email, ip)
+	case *ex.ErrQuery:
+		settle = lim.Release(u.Email)
+	default:
+		// unregistered email or no password, a guess at the accounts rather than the account
+		if settle = lim.Fail("", ip); settle == nil {
+			settle = lim.Release(u.Email)
+		}
+	}
+	if settle != nil {
+		return false, settle
+	}
+	return ok, err
+}
+
 // AccountDetails : given the email id of the account, this can fetch the user account details
 // ErrInvalid : email is empty
 // ErrNotFound : account not registered
@@ -0,0 +1,123 @@
+package auth
+
+/*
+Verify is the one call the API handlers need on a request - parse the token, check it in the cache and match the user
+the TokenState it returns tells the handler what to do next
+- clean state : let the request through
+- AuthExpired : the client can refresh, the login is still on
+- LoginExpired : the client has to login again
+- UserInvalid : token is of some other user, reject
+*/
+
+import (
+	"errors"
+	"time"
+
+	ex "github.com/eensymachines-in/errx"
+	"github.com/go-redis/redis/v7"
+)
+
+// loginOn : checks the session of the token still has a token to refresh with
+// KEYS[1] is the session set, KEYS[2] the metadata of the session - ARGV[1] the time now in unix milliseconds, ARGV[2] the prefix of reference keys
+// claims under the references outlive the tokens and do not count
+// returns 1 when the session is alive and has a token yet to expire, 0 when it has ended or all its tokens are gone
+// keys read from the session set are not in KEYS, they have the slot tag of the user as the KEYS do
+var loginOn = redis.NewScript(`
+if redis.call("EXISTS", KEYS[2]) == 0 then
+	return 0
+end
+local untl = tonumber(redis.call("HGET", KEYS[2], "until") or "0")
+if untl > 0 and tonumber(ARGV[1]) >= untl then
+	return 0
+end
+for _, k in ipairs(redis.call("SMEMBERS", KEYS[1])) do
+	if k ~= KEYS[2] and string.sub(k, 1, #ARGV[2]) ~= ARGV[2] and redis.call("EXISTS", k) == 1 then
+		return 1
+	end
+end
+return 0
+`)
+
+// Verify : parses the auth token, checks it and its session in the cache and matches the user on it
+// expectedUser : user the request is for, empty when there is none to match
+// opts : expected issuer, audience and the leeway, as with ParseWith - exp is left to the cache
+// tokens are verified with tc.Verifier, or the RefVerifier when the cache is Opaque
+// the token is nil only when the opaque reference has expired, the state is then AuthExpired
+// and LoginExpired too when the reference is gone for good or its session has nothing left to refresh with
+// refr tokens are never good to authenticate a request, only the auth token of the pair is
+// TokErr : token is malformed, not signed right, its claims are not as expected or it is a refr token, reject the request
+// ErrInvalid : there is no verifier for the tokens
+// ErrCacheQuery : cache could not be queried
+func (tc *TokenCache) Verify(ts TokenStr, expectedUser string, opts ...ParseOption) (*JWTok, *TokenState, error) {
+	v := tc.Verifier
+	if v == nil && tc.Opaque {
+		v = tc.RefVerifier()
+	}
+	if v == nil {
+		return nil, nil, ex.NewErr(&ex.ErrInvalid{}, nil, "No verifier for the tokens", "TokenCache.Verify")
+	}
+	state := &TokenState{}
+	tok, err := ts.ParseWith(v, append(opts, allowExpired())...)
+	if err != nil {
+		if !errors.Is(err, ErrTokExpired) {
+			return nil, nil, err
+		}
+		// opaque reference is no good with the auth token gone, the refr token may yet be good
+		state.AuthExpired()
+		rv, ok := v.(*refVerifier)
+		if !ok {
+			return nil, state, nil
+		}
+		claims, err := rv.tc.refClaims(string(ts))
+		if err != nil {
+			return nil, nil, err
+		}
+		user, _ := claims["user"].(string)
+		sid, _ := claims["sid"].(string)
+		if use, _ := claims["token_use"].(string); use == UseRefr {
+			return nil, nil, newTokErr(ErrTokClaims, nil, "TokenCache.Verify")
+		}
+		if err := tc.checkLogin(user, sid, state); err != nil {
+			return nil, nil, err
+		}
+		return nil, state, nil
+	}
+	if tok.Use == UseRefr {
+		return nil, nil, newTokErr(ErrTokClaims, nil, "TokenCache.Verify")
+	}
+	if expectedUser != "" && tok.User != expectedUser {
+		state.UserInvalid()
+		return tok, state, nil
+	}
+	err = tc.TokenStatus(tok)
+	if err == nil {
+		return tok, state, nil
+	}
+	if _, ok := err.(*ex.ErrTokenExpired); !ok {
+		return tok, nil, err
+	}
+	state.AuthExpired()
+	if err := tc.checkLogin(tok.User, tok.Session, state); err != nil {
+		return tok, nil, err
+	}
+	return tok, state, nil
+}
+
+// checkLogin : marks the login expired on the state unless the session has a token left to refresh with
+// without the session there is no telling if the login is on, it is taken to have expired
+// ErrCacheQuery : cache could not be queried
+func (tc *TokenCache) checkLogin(user, sid string, state *TokenState) error {
+	if user == "" || sid == "" {
+		state.LoginExpired()
+		return nil
+	}
+	keys := []string{sessKey(user, sid), metaKey(user, sid)}
+	n, err := loginOn.Run(tc.Client, keys, time.Now().UnixNano()/int64(time.Millisecond), refPrefix).Int()
+	if err != nil {
+		return ex.NewErr(&ex.ErrCacheQuery{}, err, "Failed to verify token", "TokenCache.checkLogin/loginOn.Run()")
+	}
+	if n == 0 {
+		state.LoginExpired()
+	}
+	return nil
+}
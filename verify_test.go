@@ -0,0 +1,142 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	ex "github.com/eensymachines-in/errx"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVerify(t *testing.T) {
+	cac := testCache(t)
+	defer cac.Close()
+	email := fmt.Sprintf("verify%d@gmail.com", time.Now().UnixNano())
+
+	_, _, err := cac.Verify("sometoken", email)
+	_, ok := err.(*ex.ErrInvalid)
+	assert.True(t, ok, "Unexpected error %v verifying without a verifier", err)
+
+	cac.Verifier = NewHMACVerifier("secretstring")
+	pair := &TokenPair{}
+	assert.Nil(t, cac.LoginUser(email, 2, pair, LoginLifetime(1*time.Second, 5*time.Second)), "Unexpected error logging in")
+	tokStr, _ := pair.Auth.ToString("secretstring")
+	tok, state, err := cac.Verify(tokStr, email)
+	if assert.Nil(t, err, "Unexpected error verifying token") {
+		assert.Equal(t, pair.Auth.UUID, tok.UUID, "Unexpected token verified")
+		assert.False(t, state.IsAuthExpired() || state.IsLoginExpired() || state.IsUserInvalid(), "Was expecting a clean state")
+	}
+	_, state, err = cac.Verify(tokStr, "someoneelse@gmail.com")
+	if assert.Nil(t, err, "Unexpected error verifying token") {
+		assert.True(t, state.IsUserInvalid(), "Was expecting the user invalid")
+	}
+	other, _ := pair.Auth.ToString("wrongsecret")
+	_, _, err = cac.Verify(other, email)
+	assert.True(t, errors.Is(err, ErrTokSignature), "Unexpected error %v verifying token with wrong signature", err)
+
+	<-time.After(1200 * time.Millisecond)
+	_, state, err = cac.Verify(tokStr, email)
+	if assert.Nil(t, err, "Unexpected error verifying expired token") {
+		assert.True(t, state.IsAuthExpired(), "Was expecting the auth expired")
+		assert.False(t, state.IsLoginExpired(), "Login should not have expired")
+	}
+	assert.Nil(t, cac.RevokeSession(email, pair.Auth.Session), "Unexpected error revoking session")
+	_, state, err = cac.Verify(tokStr, email)
+	if assert.Nil(t, err, "Unexpected error verifying revoked token") {
+		assert.True(t, state.IsAuthExpired(), "Was expecting the auth expired")
+		assert.True(t, state.IsLoginExpired(), "Was expecting the login expired")
+	}
+
+	opq := &TokenCache{Client: cac.Client, Opaque: true}
+	assert.Nil(t, opq.LoginUser(email, 2, pair, LoginLifetime(1*time.Second, 5*time.Second)), "Unexpected error logging in")
+	ref := TokenStr(pair.Auth.Ref)
+	tok, state, err = opq.Verify(ref, email)
+	if assert.Nil(t, err, "Unexpected error verifying reference") {
+		assert.Equal(t, pair.Auth.UUID, tok.UUID, "Unexpected token verified")
+		assert.False(t, state.IsAuthExpired(), "Was expecting the auth on")
+	}
+	<-time.After(1200 * time.Millisecond)
+	tok, state, err = opq.Verify(ref, email)
+	if assert.Nil(t, err, "Unexpected error verifying expired reference") {
+		assert.Nil(t, tok, "Was expecting no token for the expired reference")
+		assert.True(t, state.IsAuthExpired(), "Was expecting the auth expired")
+		assert.False(t, state.IsLoginExpired(), "Login should not have expired")
+	}
+	// revoked session is a login again, not a refresh
+	assert.Nil(t, opq.RevokeAllSessions(email), "Unexpected error revoking sessions")
+	_, state, err = opq.Verify(ref, email)
+	if assert.Nil(t, err, "Unexpected error verifying revoked reference") {
+		assert.True(t, state.IsAuthExpired(), "Was expecting the auth expired")
+		assert.True(t, state.IsLoginExpired(), "Was expecting the login expired")
+	}
+	// refr token logged out, the reference to the auth token then runs out
+	assert.Nil(t, opq.LoginUser(email, 2, pair, LoginLifetime(1*time.Second, 5*time.Second)), "Unexpected error logging in")
+	ref = TokenStr(pair.Auth.Ref)
+	assert.Nil(t, opq.LogoutToken(pair.Refr), "Unexpected error logging out refr token")
+	<-time.After(1200 * time.Millisecond)
+	_, state, err = opq.Verify(ref, email)
+	if assert.Nil(t, err, "Unexpected error verifying expired reference") {
+		assert.True(t, state.IsLoginExpired(), "Was expecting the login expired")
+	}
+	opq.RevokeAllSessions(email)
+}
+
+func TestVerifyTokenUse(t *testing.T) {
+	cac := testCache(t)
+	defer cac.Close()
+	cac.Verifier = NewHMACVerifier("secretstring")
+	email := fmt.Sprintf("verifyuse%d@gmail.com", time.Now().UnixNano())
+
+	pair := &TokenPair{}
+	assert.Nil(t, cac.LoginUser(email, 2, pair, LoginLifetime(1*time.Second, 5*time.Second)), "Unexpected error logging in")
+	assert.Equal(t, UseAuth, pair.Auth.Use, "Unexpected use of the auth token")
+	assert.Equal(t, UseRefr, pair.Refr.Use, "Unexpected use of the refr token")
+	refrStr, _ := pair.Refr.ToString("secretstring")
+	_, _, err := cac.Verify(refrStr, email)
+	assert.True(t, errors.Is(err, ErrTokClaims), "Unexpected error %v verifying refr token", err)
+	assert.NotNil(t, cac.RefreshUser(pair.Auth, &TokenPair{}), "Auth token should not refresh")
+
+	opq := &TokenCache{Client: cac.Client, Opaque: true}
+	assert.Nil(t, opq.LoginUser(email, 2, pair, LoginLifetime(1*time.Second, 5*time.Second)), "Unexpected error logging in")
+	_, _, err = opq.Verify(TokenStr(pair.Refr.Ref), email)
+	assert.True(t, errors.Is(err, ErrTokClaims), "Unexpected error %v verifying refr reference", err)
+	tok, state, err := opq.Verify(TokenStr(pair.Auth.Ref), email)
+	if assert.Nil(t, err, "Unexpected error verifying auth reference") {
+		assert.Equal(t, UseAuth, tok.Use, "Unexpected use of the auth reference")
+		assert.False(t, state.IsAuthExpired(), "Was expecting the auth on")
+	}
+	cac.RevokeAllSessions(email)
+}
+
+func TestVerifyLogout(t *testing.T) {
+	cac := testCache(t)
+	defer cac.Close()
+	cac.Verifier = NewHMACVerifier("secretstring")
+	email := fmt.Sprintf("verifylogout%d@gmail.com", time.Now().UnixNano())
+
+	// logged out all the way, there is nothing to refresh with
+	pair := &TokenPair{}
+	assert.Nil(t, cac.LoginUser(email, 2, pair, LoginLifetime(5*time.Second, 10*time.Second)), "Unexpected error logging in")
+	tokStr, _ := pair.Auth.ToString("secretstring")
+	assert.Nil(t, cac.LogoutToken(pair.Auth), "Unexpected error logging out auth token")
+	assert.Nil(t, cac.LogoutToken(pair.Refr), "Unexpected error logging out refr token")
+	_, state, err := cac.Verify(tokStr, email)
+	if assert.Nil(t, err, "Unexpected error verifying logged out token") {
+		assert.True(t, state.IsAuthExpired(), "Was expecting the auth expired")
+		assert.True(t, state.IsLoginExpired(), "Was expecting the login expired")
+	}
+
+	// refr token logged out, the auth token then runs out
+	assert.Nil(t, cac.LoginUser(email, 2, pair, LoginLifetime(1*time.Second, 10*time.Second)), "Unexpected error logging in")
+	tokStr, _ = pair.Auth.ToString("secretstring")
+	assert.Nil(t, cac.LogoutToken(pair.Refr), "Unexpected error logging out refr token")
+	<-time.After(1200 * time.Millisecond)
+	_, state, err = cac.Verify(tokStr, email)
+	if assert.Nil(t, err, "Unexpected error verifying expired token") {
+		assert.True(t, state.IsAuthExpired(), "Was expecting the auth expired")
+		assert.True(t, state.IsLoginExpired(), "Was expecting the login expired")
+	}
+	cac.RevokeAllSessions(email)
+}